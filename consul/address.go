@@ -0,0 +1,84 @@
+package consul
+
+import (
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	// AddressModeAuto uses the wan address of the instances in other
+	// datacenters, and the lan address of the local ones
+	AddressModeAuto = "auto"
+	AddressModeLAN  = "lan"
+	AddressModeWAN  = "wan"
+)
+
+// wanAddressKeys are the tagged addresses used to reach an instance from
+// another datacenter, by order of preference
+var wanAddressKeys = []string{"wan", "wan_ipv4", "wan_ipv6"}
+
+// wanServiceEntry returns a copy of n using its wan address when it has
+// one, the service ones taking precedence over the node ones
+func wanServiceEntry(n *api.ServiceEntry) *api.ServiceEntry {
+	svc := *n.Service
+	e := *n
+	e.Service = &svc
+
+	for _, k := range wanAddressKeys {
+		if wan, ok := svc.TaggedAddresses[k]; ok && wan.Address != "" {
+			svc.Address = wan.Address
+			if wan.Port != 0 {
+				svc.Port = wan.Port
+			}
+			return &e
+		}
+	}
+	if n.Node == nil {
+		return &e
+	}
+	for _, k := range wanAddressKeys {
+		if wan, ok := n.Node.TaggedAddresses[k]; ok && wan != "" {
+			svc.Address = wan
+			return &e
+		}
+	}
+	return &e
+}
+
+// upstreamAddressMode reads the address_mode config of up
+func (w *Watcher) upstreamAddressMode(up *upstream) string {
+	v, _ := w.configValue("address_mode", up.Config, "")
+	mode, _ := v.(string)
+	switch mode {
+	case AddressModeLAN, AddressModeWAN, AddressModeAuto:
+		return mode
+	case "":
+	default:
+		w.log.Errorf("upstream %s: bad address_mode value in config: %s. Using default: %s", up.Name, mode, AddressModeAuto)
+	}
+	return AddressModeAuto
+}
+
+// upstreamAddresses returns the instances of up with the address to reach
+// them, according to the address mode of up
+func (w *Watcher) upstreamAddresses(up *upstream, nodes []*api.ServiceEntry) []*api.ServiceEntry {
+	switch up.Settings.AddressMode {
+	case AddressModeLAN:
+		return nodes
+	case AddressModeWAN:
+		return wanServiceEntries(nodes)
+	}
+
+	// the datacenter of the instances of peers is their cluster's one
+	if up.Peer != "" {
+		return nodes
+	}
+
+	res := make([]*api.ServiceEntry, 0, len(nodes))
+	for _, n := range nodes {
+		if n.Node != nil && n.Node.Datacenter != "" && n.Node.Datacenter != w.datacenter {
+			n = wanServiceEntry(n)
+		}
+		res = append(res, n)
+	}
+	return res
+}
@@ -0,0 +1,76 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamAddresses(t *testing.T) {
+	w := &Watcher{
+		log:        NewTestingLogger(t),
+		datacenter: "dc1",
+	}
+
+	entry := func(dc string) *api.ServiceEntry {
+		return &api.ServiceEntry{
+			Node: &api.Node{
+				Datacenter:      dc,
+				Address:         "10.0.0.1",
+				TaggedAddresses: map[string]string{"lan": "10.0.0.1", "wan": "1.1.1.1"},
+			},
+			Service: &api.AgentService{
+				Port:    8080,
+				Weights: api.AgentWeights{Passing: 1},
+			},
+		}
+	}
+	serviceWan := entry("dc2")
+	serviceWan.Service.Address = "10.0.0.2"
+	serviceWan.Service.TaggedAddresses = map[string]api.ServiceAddress{
+		"wan_ipv4": {Address: "2.2.2.2", Port: 9090},
+	}
+
+	entries := []*api.ServiceEntry{entry("dc1"), entry("dc2"), serviceWan}
+
+	for _, tc := range []struct {
+		mode     string
+		expected []UpstreamNode
+	}{
+		{
+			mode: "",
+			expected: []UpstreamNode{
+				{Host: "10.0.0.1", Port: 8080, Weight: 1},
+				{Host: "1.1.1.1", Port: 8080, Weight: 1},
+				{Host: "2.2.2.2", Port: 9090, Weight: 1},
+			},
+		},
+		{
+			mode: AddressModeLAN,
+			expected: []UpstreamNode{
+				{Host: "10.0.0.1", Port: 8080, Weight: 1},
+				{Host: "10.0.0.1", Port: 8080, Weight: 1},
+				{Host: "10.0.0.2", Port: 8080, Weight: 1},
+			},
+		},
+		{
+			mode: AddressModeWAN,
+			expected: []UpstreamNode{
+				{Host: "1.1.1.1", Port: 8080, Weight: 1},
+				{Host: "1.1.1.1", Port: 8080, Weight: 1},
+				{Host: "2.2.2.2", Port: 9090, Weight: 1},
+			},
+		},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			var alive, total int
+			up := &upstream{Name: "up", Config: map[string]interface{}{"address_mode": tc.mode}}
+			w.updateUpstreamSettings(up)
+			require.Equal(t, tc.expected, w.genUpstreamNodes(entries, up, &alive, &total))
+		})
+	}
+
+	// the instances are not modified
+	require.Equal(t, "10.0.0.2", serviceWan.Service.Address)
+}
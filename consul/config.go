@@ -6,11 +6,104 @@ import (
 	"time"
 )
 
+// Gateway kinds, named after the kind of the gateway consul service
+const (
+	GatewayIngress     = "ingress-gateway"
+	GatewayTerminating = "terminating-gateway"
+	GatewayMesh        = "mesh-gateway"
+)
+
 type Config struct {
 	ServiceName string
 	ServiceID   string
-	Downstream  Downstream
-	Upstreams   []Upstream
+	// Namespace and Partition of the service, empty when consul does not
+	// support them
+	Namespace string
+	Partition string
+	// Gateway is the gateway kind when running as a gateway, in which case
+	// there is no Downstream
+	Gateway    string
+	Downstream Downstream
+	Upstreams  []Upstream
+	// TerminatingServices are the services a terminating gateway proxies to
+	TerminatingServices []TerminatingService
+	// MeshGatewayRoutes are the destinations a mesh gateway routes to
+	MeshGatewayRoutes []MeshGatewayRoute
+
+	// Intentions apply to the proxied services, sorted by decreasing
+	// precedence. IntentionsDefaultAllow is used when none match.
+	Intentions             []Intention
+	IntentionsDefaultAllow bool
+}
+
+// Intention allows or denies the connections from a source service to a
+// destination service, names can be the * wildcard
+type Intention struct {
+	// SourcePartition is empty for sources in the local partition
+	SourcePartition string
+	SourceNS        string
+	SourceName      string
+	DestinationNS   string
+	DestinationName string
+	Allow           bool
+	Precedence      int
+	// Permissions are the L7 rules of the intention, in which case Allow
+	// is ignored
+	Permissions []IntentionPermission
+}
+
+// IntentionPermission allows or denies the HTTP requests matching HTTP,
+// the first matching permission of an intention decides
+type IntentionPermission struct {
+	Allow bool
+	HTTP  *IntentionHTTPPermission
+}
+
+type IntentionHTTPPermission struct {
+	PathExact  string
+	PathPrefix string
+	PathRegex  string
+	Methods    []string
+	Headers    []UpstreamHeaderMatch
+}
+
+// MeshGatewayRoute sends the connections whose SNI matches to Nodes. Local
+// services are matched on their exact SNI, and remote datacenters on the SNI
+// suffix of their services, routing to their mesh gateways.
+type MeshGatewayRoute struct {
+	Name string
+	// Namespace of the local services, empty for remote datacenters
+	Namespace      string
+	SNI            string
+	Remote         bool
+	ConnectTimeout time.Duration
+
+	Nodes []UpstreamNode
+}
+
+// TerminatingService is a service outside of the mesh, reached through a
+// terminating gateway. The gateway presents the TLS leaf certificate of the
+// service to the mesh, and connects to its nodes with ExternalTLS when set.
+type TerminatingService struct {
+	Name string
+	// Namespace of the service, which can differ from the one of the
+	// gateway
+	Namespace      string
+	SNI            string
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+
+	TLS
+	ExternalTLS *ExternalTLS
+
+	Nodes []UpstreamNode
+}
+
+// ExternalTLS holds the TLS settings used to connect to a service outside
+// of the mesh, Cert and Key are empty when no client certificate is used
+type ExternalTLS struct {
+	TLS
+	SNI string
 }
 
 type Upstream struct {
@@ -20,10 +113,27 @@ type Upstream struct {
 	Protocol         string
 	ConnectTimeout   time.Duration
 	ReadTimeout      time.Duration
+	// SNI is sent to Nodes, which can be mesh gateways routing on it, and
+	// SpiffeID is the identity Nodes certificates are expected to have
+	SNI      string
+	SpiffeID string
+	// Datacenter is the datacenter a prepared query upstream is served
+	// from, which is not the local one after a failover
+	Datacenter string
+	Balance    UpstreamBalance
+	// OutlierDetection is set to mark down the nodes failing requests
+	OutlierDetection *OutlierDetection
+	// Limits is set to cap the connections to the nodes
+	Limits *UpstreamLimits
 
 	TLS
 
 	Nodes []UpstreamNode
+
+	// Targets and Routes are set when the upstream discovery chain does more
+	// than resolving to the destination service, in which case Nodes is empty
+	Targets []UpstreamTarget
+	Routes  []UpstreamRoute
 }
 
 func (n Upstream) Equal(o Upstream) bool {
@@ -32,10 +142,97 @@ func (n Upstream) Equal(o Upstream) bool {
 		n.TLS.Equal(o.TLS)
 }
 
+// UpstreamTarget is a set of instances an upstream can route to, as
+// resolved by a service-resolver
+type UpstreamTarget struct {
+	Name           string
+	ConnectTimeout time.Duration
+	SNI            string
+	SpiffeID       string
+	Balance        UpstreamBalance
+
+	Nodes []UpstreamNode
+}
+
+// OutlierDetection marks down the nodes of an upstream after
+// ConsecutiveErrors errors observed on the traffic at the Observe layer, until
+// their health checks, every Interval, succeed again
+type OutlierDetection struct {
+	Observe           string
+	ConsecutiveErrors int
+	Interval          time.Duration
+}
+
+// UpstreamLimits caps the connections to each node of an upstream to
+// MaxConnections. Requests above it are queued, up to MaxPendingRequests per
+// node when set, and for QueueTimeout when set, the connect timeout otherwise.
+type UpstreamLimits struct {
+	MaxConnections     int
+	MaxPendingRequests int
+	QueueTimeout       time.Duration
+}
+
+// UpstreamBalance is the load balancing algorithm of an upstream, the zero
+// value being the default one. HdrName and URLParam are the header and url
+// parameter hashed by the hdr and url_param algorithms.
+type UpstreamBalance struct {
+	Algorithm string
+	HdrName   string
+	URLParam  string
+}
+
+// UpstreamRoute sends the traffic matching Match to targets
+// according to the weights of Splits
+type UpstreamRoute struct {
+	Match  UpstreamRouteMatch
+	Splits []UpstreamSplit
+}
+
+// UpstreamRouteMatch holds the conditions of a route, the zero value
+// matches everything
+type UpstreamRouteMatch struct {
+	Hosts       []string
+	PathExact   string
+	PathPrefix  string
+	PathRegex   string
+	Methods     []string
+	Headers     []UpstreamHeaderMatch
+	QueryParams []UpstreamQueryParamMatch
+}
+
+type UpstreamHeaderMatch struct {
+	Name    string
+	Present bool
+	Exact   string
+	Prefix  string
+	Suffix  string
+	Regex   string
+	Invert  bool
+}
+
+type UpstreamQueryParamMatch struct {
+	Name    string
+	Present bool
+	Exact   string
+	Regex   string
+}
+
+// UpstreamSplit sends Weight percent of the traffic to Target
+type UpstreamSplit struct {
+	Weight float32
+	Target string
+}
+
 type UpstreamNode struct {
 	Host   string
 	Port   int
 	Weight int
+	// Backup nodes only receive traffic when no other node is available
+	Backup bool
+	// SNI and SpiffeID override the ones of the upstream or target for
+	// nodes with another identity, as the ones of failover targets
+	SNI      string
+	SpiffeID string
 }
 
 func (n UpstreamNode) ID() string {
@@ -57,6 +254,8 @@ type Downstream struct {
 
 	EnableForwardFor  bool
 	AppNameHeaderName string
+	// AppNSHeaderName is the header set to the namespace of the source
+	AppNSHeaderName string
 
 	TLS
 }
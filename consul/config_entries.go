@@ -0,0 +1,110 @@
+package consul
+
+import (
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func (w *Watcher) watchConfigEntries(kind string, handler func(entries []api.ConfigEntry)) {
+	w.log.Infof("consul: watching %s config entries", kind)
+
+	var lastIndex uint64
+	first := true
+	for {
+		entries, meta, err := w.consul.ConfigEntries().List(kind, &api.QueryOptions{
+			WaitIndex: lastIndex,
+			WaitTime:  10 * time.Minute,
+		})
+		if err != nil {
+			w.log.Errorf("consul: error fetching %s config entries: %s", kind, err)
+			time.Sleep(errorWaitTime)
+			lastIndex = 0
+			continue
+		}
+
+		changed := lastIndex != meta.LastIndex
+		lastIndex = meta.LastIndex
+
+		if changed {
+			w.log.Debugf("consul: %s config entries changed", kind)
+			w.lock.Lock()
+			handler(entries)
+			w.updateSettings()
+			w.lock.Unlock()
+			w.notifyChanged()
+		}
+
+		if first {
+			w.ready.Done()
+			first = false
+		}
+	}
+}
+
+func (w *Watcher) handleServiceDefaults(entries []api.ConfigEntry) {
+	w.serviceDefaults = make(map[string]*api.ServiceConfigEntry)
+	for _, e := range entries {
+		if sd, ok := e.(*api.ServiceConfigEntry); ok {
+			w.serviceDefaults[sd.Name] = sd
+		}
+	}
+}
+
+func (w *Watcher) handleProxyDefaults(entries []api.ConfigEntry) {
+	w.proxyDefaults = nil
+	for _, e := range entries {
+		if pd, ok := e.(*api.ProxyConfigEntry); ok && pd.Name == api.ProxyConfigGlobal {
+			w.proxyDefaults = pd
+		}
+	}
+}
+
+// configValue looks up a proxy configuration key, by order of precedence in:
+// the registration config, the service-defaults of service and proxy-defaults
+func (w *Watcher) configValue(key string, regConfig map[string]interface{}, service string) (interface{}, bool) {
+	if v, ok := regConfig[key]; ok {
+		return v, true
+	}
+
+	if key == "protocol" {
+		if sd, ok := w.serviceDefaults[service]; ok && sd.Protocol != "" {
+			return sd.Protocol, true
+		}
+	}
+
+	if w.proxyDefaults != nil {
+		if v, ok := w.proxyDefaults.Config[key]; ok {
+			return v, true
+		}
+	}
+
+	return nil, false
+}
+
+func (w *Watcher) protocol(regConfig map[string]interface{}, service string) string {
+	v, _ := w.configValue("protocol", regConfig, service)
+	p, _ := v.(string)
+	return p
+}
+
+func (w *Watcher) timeout(key string, regConfig map[string]interface{}, def time.Duration, owner string) time.Duration {
+	v, ok := w.configValue(key, regConfig, "")
+	if !ok {
+		return def
+	}
+
+	s, ok := v.(string)
+	if !ok {
+		w.log.Errorf("%s: bad %s value in config: %v. Using default: %s", owner, key, v, def)
+		return def
+	}
+
+	to, err := time.ParseDuration(s)
+	if err != nil {
+		w.log.Errorf("%s: bad %s value in config: %s. Using default: %s", owner, key, err, def)
+		return def
+	}
+
+	return to
+}
@@ -0,0 +1,184 @@
+package consul
+
+import (
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// isSimpleChain returns true when the chain only resolves to the
+// destination service itself, without routing, splitting, subsets or failover
+func isSimpleChain(chain *api.CompiledDiscoveryChain) bool {
+	start, ok := chain.Nodes[chain.StartNode]
+	if !ok || start.Type != api.DiscoveryGraphNodeTypeResolver || start.Resolver == nil {
+		return false
+	}
+	if start.Resolver.Failover != nil && len(start.Resolver.Failover.Targets) > 0 {
+		return false
+	}
+
+	target, ok := chain.Targets[start.Resolver.Target]
+	if !ok {
+		return false
+	}
+
+	return target.Service == chain.ServiceName && target.ServiceSubset == ""
+}
+
+// chainRoutes flattens the discovery chain graph into an ordered list of routes
+func chainRoutes(chain *api.CompiledDiscoveryChain) []UpstreamRoute {
+	start, ok := chain.Nodes[chain.StartNode]
+	if !ok {
+		return nil
+	}
+
+	if start.Type != api.DiscoveryGraphNodeTypeRouter {
+		return []UpstreamRoute{
+			{
+				Splits: chainSplits(chain, chain.StartNode, 100),
+			},
+		}
+	}
+
+	routes := make([]UpstreamRoute, 0, len(start.Routes))
+	for _, r := range start.Routes {
+		routes = append(routes, UpstreamRoute{
+			Match:  routeMatch(r.Definition),
+			Splits: chainSplits(chain, r.NextNode, 100),
+		})
+	}
+
+	return routes
+}
+
+func chainSplits(chain *api.CompiledDiscoveryChain, name string, weight float32) []UpstreamSplit {
+	node, ok := chain.Nodes[name]
+	if !ok {
+		return nil
+	}
+
+	switch node.Type {
+	case api.DiscoveryGraphNodeTypeSplitter:
+		splits := []UpstreamSplit{}
+		for _, s := range node.Splits {
+			splits = append(splits, chainSplits(chain, s.NextNode, weight*s.Weight/100)...)
+		}
+		return splits
+	case api.DiscoveryGraphNodeTypeResolver:
+		if node.Resolver == nil {
+			return nil
+		}
+		return []UpstreamSplit{
+			{
+				Weight: weight,
+				Target: node.Resolver.Target,
+			},
+		}
+	}
+
+	return nil
+}
+
+// chainTargets returns the ids of the targets the chain routes or fails
+// over to
+func chainTargets(chain *api.CompiledDiscoveryChain) []string {
+	targets := routesTargets(chainRoutes(chain))
+	seen := map[string]bool{}
+	for _, id := range targets {
+		seen[id] = true
+	}
+	for _, failovers := range chainFailovers(chain) {
+		for _, id := range failovers {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			targets = append(targets, id)
+		}
+	}
+	return targets
+}
+
+// chainFailovers returns the failover targets set by service-resolver
+// config entries, indexed by the id of the target they fail over from
+func chainFailovers(chain *api.CompiledDiscoveryChain) map[string][]string {
+	failovers := map[string][]string{}
+	for _, node := range chain.Nodes {
+		if node.Type != api.DiscoveryGraphNodeTypeResolver || node.Resolver == nil {
+			continue
+		}
+		if node.Resolver.Failover == nil || len(node.Resolver.Failover.Targets) == 0 {
+			continue
+		}
+		failovers[node.Resolver.Target] = node.Resolver.Failover.Targets
+	}
+	return failovers
+}
+
+// routesTargets returns the ids of the targets referenced by routes
+func routesTargets(routes []UpstreamRoute) []string {
+	seen := map[string]bool{}
+	targets := []string{}
+	for _, r := range routes {
+		for _, s := range r.Splits {
+			if seen[s.Target] {
+				continue
+			}
+			seen[s.Target] = true
+			targets = append(targets, s.Target)
+		}
+	}
+	return targets
+}
+
+// chainConnectTimeouts returns the connect timeouts set by service-resolver
+// config entries, indexed by target id
+func chainConnectTimeouts(chain *api.CompiledDiscoveryChain) map[string]time.Duration {
+	timeouts := map[string]time.Duration{}
+	for _, node := range chain.Nodes {
+		if node.Type != api.DiscoveryGraphNodeTypeResolver || node.Resolver == nil {
+			continue
+		}
+		if node.Resolver.Default || node.Resolver.ConnectTimeout == 0 {
+			continue
+		}
+		timeouts[node.Resolver.Target] = node.Resolver.ConnectTimeout
+	}
+	return timeouts
+}
+
+func routeMatch(def *api.ServiceRoute) UpstreamRouteMatch {
+	m := UpstreamRouteMatch{}
+	if def == nil || def.Match == nil || def.Match.HTTP == nil {
+		return m
+	}
+
+	h := def.Match.HTTP
+	m.PathExact = h.PathExact
+	m.PathPrefix = h.PathPrefix
+	m.PathRegex = h.PathRegex
+	m.Methods = h.Methods
+
+	for _, hdr := range h.Header {
+		m.Headers = append(m.Headers, UpstreamHeaderMatch{
+			Name:    hdr.Name,
+			Present: hdr.Present,
+			Exact:   hdr.Exact,
+			Prefix:  hdr.Prefix,
+			Suffix:  hdr.Suffix,
+			Regex:   hdr.Regex,
+			Invert:  hdr.Invert,
+		})
+	}
+
+	for _, q := range h.QueryParam {
+		m.QueryParams = append(m.QueryParams, UpstreamQueryParamMatch{
+			Name:    q.Name,
+			Present: q.Present,
+			Exact:   q.Exact,
+			Regex:   q.Regex,
+		})
+	}
+
+	return m
+}
@@ -0,0 +1,137 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func (w *Watcher) startGateway() error {
+	switch w.gateway {
+	case GatewayIngress, GatewayTerminating, GatewayMesh:
+	default:
+		return fmt.Errorf("unsupported gateway kind %s", w.gateway)
+	}
+
+	svc, _, err := w.consul.Agent().Service(w.service, &api.QueryOptions{})
+	if err != nil {
+		return err
+	}
+
+	w.serviceName = svc.Service
+	w.namespace = svc.Namespace
+
+	err = w.loadAgentConfig()
+	if err != nil {
+		return err
+	}
+
+	w.ready.Add(3)
+
+	go w.watchCA()
+	go w.watchLeaf()
+	go w.watchService(w.service, w.handleGatewayChange)
+
+	switch w.gateway {
+	case GatewayIngress:
+		w.ready.Add(2)
+		go w.watchGatewayConfigEntry(w.handleIngressGateway)
+		go w.watchServiceResolvers()
+	case GatewayTerminating:
+		w.ready.Add(1)
+		go w.watchGatewayConfigEntry(w.handleTerminatingGateway)
+		// with the http client, the intentions of the linked services are
+		// watched along with them
+		if w.http == nil {
+			w.ready.Add(1)
+			go w.watchIntentions()
+		}
+	case GatewayMesh:
+		w.ready.Add(2)
+		go w.watchMeshServices()
+		go w.watchMeshDatacenters()
+	}
+
+	return nil
+}
+
+func (w *Watcher) handleGatewayChange(first bool, srv *api.AgentService) error {
+	w.lock.Lock()
+	w.downstream.LocalBindAddress = DefaultDownstreamBindAddr
+	w.downstream.LocalBindPort = srv.Port
+	w.downstream.Config = nil
+	if srv.Proxy != nil && srv.Proxy.Config != nil {
+		w.downstream.Config = srv.Proxy.Config
+		if b, ok := srv.Proxy.Config["bind_address"].(string); ok {
+			w.downstream.LocalBindAddress = b
+		}
+	}
+	w.updateDownstreamSettings()
+	if w.gateway == GatewayIngress {
+		w.updateIngressListeners(false)
+	}
+	w.lock.Unlock()
+
+	if first {
+		w.ready.Done()
+	}
+	return nil
+}
+
+// watchGatewayConfigEntry watches the config entry of the gateway, named
+// after the gateway service. handler is called with the lock held, and a
+// nil entry when there is none.
+func (w *Watcher) watchGatewayConfigEntry(handler func(first bool, entry json.RawMessage)) {
+	w.log.Infof("consul: watching %s config entry %s", w.gateway, w.serviceName)
+
+	var lastIndex uint64
+	first := true
+	for {
+		var entries []json.RawMessage
+		meta, err := w.consul.Raw().Query(fmt.Sprintf("/v1/config/%s", w.gateway), &entries, &api.QueryOptions{
+			WaitIndex: lastIndex,
+			WaitTime:  10 * time.Minute,
+		})
+		if err != nil {
+			w.log.Errorf("consul: error fetching %s config entries: %s", w.gateway, err)
+			time.Sleep(errorWaitTime)
+			lastIndex = 0
+			continue
+		}
+
+		changed := lastIndex != meta.LastIndex
+		lastIndex = meta.LastIndex
+
+		if changed {
+			var entry json.RawMessage
+			for _, e := range entries {
+				var named struct {
+					Name string
+				}
+				err := json.Unmarshal(e, &named)
+				if err != nil {
+					w.log.Errorf("consul: error decoding %s config entry: %s", w.gateway, err)
+					continue
+				}
+				if named.Name == w.serviceName {
+					entry = e
+				}
+			}
+			if entry == nil {
+				w.log.Warnf("consul: no %s config entry found for %s", w.gateway, w.serviceName)
+			}
+
+			w.lock.Lock()
+			handler(first, entry)
+			w.lock.Unlock()
+			w.notifyChanged()
+		}
+
+		if first {
+			w.ready.Done()
+			first = false
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// HTTPClient performs the consul API requests the version of the consul api
+// we use cannot express, such as ones with query parameters it does not know.
+// That version also predates the peerings, the gateway config entries, the L7
+// intentions and the service-resolver load balancers, so the responses
+// carrying them are decoded into types declared in this package, with Query
+// or the Raw client.
+type HTTPClient struct {
+	Client *http.Client
+	// Scheme and Address of the consul agent
+	Scheme  string
+	Address string
+	// Token is sent when set, the transport of Client can also set it
+	Token string
+}
+
+// Query performs a GET request on path, which can block with q.WaitIndex,
+// and decodes the response in out
+func (c *HTTPClient) Query(path string, params url.Values, out interface{}, q *api.QueryOptions) (*api.QueryMeta, error) {
+	if params == nil {
+		params = url.Values{}
+	}
+	if q != nil {
+		if q.Namespace != "" {
+			params.Set("ns", q.Namespace)
+		}
+		if q.Datacenter != "" {
+			params.Set("dc", q.Datacenter)
+		}
+		if q.Filter != "" {
+			params.Set("filter", q.Filter)
+		}
+		for k, v := range q.NodeMeta {
+			params.Add("node-meta", k+":"+v)
+		}
+		if q.WaitIndex != 0 {
+			params.Set("index", strconv.FormatUint(q.WaitIndex, 10))
+		}
+		if q.WaitTime != 0 {
+			params.Set("wait", fmt.Sprintf("%dms", q.WaitTime/time.Millisecond))
+		}
+	}
+
+	u := url.URL{
+		Scheme:   c.Scheme,
+		Host:     c.Address,
+		Path:     path,
+		RawQuery: params.Encode(),
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.Token != "" {
+		req.Header.Set(tokenHeader, c.Token)
+	}
+
+	start := time.Now()
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("Unexpected response code: %d (%s)", resp.StatusCode, body)
+	}
+
+	meta := &api.QueryMeta{
+		RequestTime: time.Since(start),
+	}
+	if index := resp.Header.Get("X-Consul-Index"); index != "" {
+		meta.LastIndex, err = strconv.ParseUint(index, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid X-Consul-Index %s: %s", index, err)
+		}
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(out)
+	if err != nil {
+		return nil, err
+	}
+
+	return meta, nil
+}
@@ -0,0 +1,44 @@
+package consul
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPClientQuery(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/health/connect/db", r.URL.Path)
+		require.Equal(t, "dc2", r.URL.Query().Get("peer"))
+		require.Equal(t, "42", r.URL.Query().Get("index"))
+		require.Equal(t, "60000ms", r.URL.Query().Get("wait"))
+		require.Equal(t, "secret", r.Header.Get(tokenHeader))
+		w.Header().Set("X-Consul-Index", "43")
+		w.Write([]byte(`[{"Service":{"Service":"db","Port":8080}}]`))
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	c := &HTTPClient{
+		Client:  srv.Client(),
+		Scheme:  u.Scheme,
+		Address: u.Host,
+		Token:   "secret",
+	}
+
+	var nodes []*api.ServiceEntry
+	meta, err := c.Query("/v1/health/connect/db", url.Values{"peer": []string{"dc2"}}, &nodes, &api.QueryOptions{
+		WaitIndex: 42,
+		WaitTime:  time.Minute,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(43), meta.LastIndex)
+	require.Len(t, nodes, 1)
+	require.Equal(t, 8080, nodes[0].Service.Port)
+}
@@ -0,0 +1,117 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// ingressGatewayConfigEntry decodes the listeners of an ingress-gateway
+// config entry, and the services each of them exposes
+type ingressGatewayConfigEntry struct {
+	Kind      string
+	Name      string
+	Listeners []ingressListener
+}
+
+type ingressListener struct {
+	Port     int
+	Protocol string
+	Services []ingressService
+}
+
+type ingressService struct {
+	Name  string
+	Hosts []string
+}
+
+// handleIngressGateway updates the ingress listeners from the ingress-gateway
+// config entry, it must be called with the lock held
+func (w *Watcher) handleIngressGateway(first bool, entry json.RawMessage) {
+	w.ingress = nil
+	if entry != nil {
+		e := &ingressGatewayConfigEntry{}
+		err := json.Unmarshal(entry, e)
+		if err != nil {
+			w.log.Errorf("consul: error decoding %s config entry %s: %s", GatewayIngress, w.serviceName, err)
+		} else {
+			w.ingress = e
+		}
+	}
+	w.updateIngressListeners(first)
+}
+
+// updateIngressListeners maps each ingress listener to an upstream routing to
+// the listener services, it must be called with the lock held
+func (w *Watcher) updateIngressListeners(startup bool) {
+	keep := make(map[string]bool)
+
+	if w.ingress != nil {
+		for _, l := range w.ingress.Listeners {
+			name := fmt.Sprintf("ingress_%d", l.Port)
+			keep[name] = true
+
+			u, ok := w.upstreams[name]
+			if !ok {
+				w.log.Infof("consul: adding ingress listener on port %d", l.Port)
+				u = &upstream{
+					Name:    name,
+					Targets: make(map[string]*upstreamTarget),
+				}
+				w.upstreams[name] = u
+			}
+
+			u.LocalBindAddress = w.downstream.LocalBindAddress
+			u.LocalBindPort = l.Port
+			u.Config = map[string]interface{}{
+				"protocol": l.Protocol,
+			}
+			w.updateUpstreamSettings(u)
+
+			targets := make(map[string]*api.DiscoveryTarget)
+			u.Routes = []UpstreamRoute{}
+			for _, s := range l.Services {
+				if s.Name == "*" {
+					w.log.Errorf("consul: ingress listener on port %d: wildcard services are not supported", l.Port)
+					continue
+				}
+
+				route := UpstreamRoute{
+					Splits: []UpstreamSplit{
+						{
+							Weight: 100,
+							Target: s.Name,
+						},
+					},
+				}
+				if l.Protocol != "tcp" {
+					route.Match.Hosts = s.Hosts
+					if len(route.Match.Hosts) == 0 {
+						route.Match.Hosts = []string{fmt.Sprintf("%s.ingress.*", s.Name)}
+					}
+				}
+				u.Routes = append(u.Routes, route)
+
+				targets[s.Name] = &api.DiscoveryTarget{
+					ID:      s.Name,
+					Service: s.Name,
+				}
+			}
+
+			w.setUpstreamTargets(startup, u, targets)
+		}
+	}
+
+	for name, u := range w.upstreams {
+		if keep[name] {
+			continue
+		}
+		w.log.Infof("consul: removing ingress listener %s", name)
+		u.done = true
+		for _, t := range u.Targets {
+			t.done = true
+		}
+		delete(w.upstreams, name)
+	}
+}
@@ -0,0 +1,290 @@
+package consul
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// intention extends api.Intention with the source partition and the L7
+// permissions, the HTTP requests matching them being allowed or denied
+// instead of the whole connection
+type intention struct {
+	api.Intention
+	SourcePartition string
+	Permissions     []*intentionPermission
+}
+
+type intentionPermission struct {
+	Action string
+	HTTP   *intentionHTTPPermission
+}
+
+type intentionHTTPPermission struct {
+	PathExact  string
+	PathPrefix string
+	PathRegex  string
+	Header     []intentionHTTPHeaderPermission
+	Methods    []string
+}
+
+type intentionHTTPHeaderPermission struct {
+	Name    string
+	Present bool
+	Exact   string
+	Prefix  string
+	Suffix  string
+	Regex   string
+	Invert  bool
+}
+
+// serviceIntentions are the intentions matching a destination service,
+// watched until done
+type serviceIntentions struct {
+	Intentions []*intention
+
+	done bool
+}
+
+// NewIntentions builds a watcher of the intentions of all services, for a
+// standalone SPOE agent
+func NewIntentions(consul *api.Client, log Logger) *Watcher {
+	w := New("", consul, log)
+	w.intentionsOnly = true
+	return w
+}
+
+func (w *Watcher) startIntentions() error {
+	err := w.loadAgentConfig()
+	if err != nil {
+		return err
+	}
+
+	w.ready.Add(1)
+	go w.watchIntentions()
+
+	return nil
+}
+
+// watchIntentions keeps the intentions up to date. Proxies block on the ones
+// matching their service with the match endpoint. Standalone agents watch all
+// of them, as do proxies without the http client the match endpoint requires
+// since the consul api cannot express its query parameters.
+func (w *Watcher) watchIntentions() {
+	switch {
+	case w.intentionsOnly:
+		// a standalone agent needs the intentions of all namespaces
+		w.watchAllIntentions("*")
+	case w.http == nil:
+		w.log.Warnf("consul: cannot match the intentions of %s without the http client, watching all of them", w.serviceName)
+		namespace := ""
+		if w.gateway == GatewayTerminating {
+			// the linked services can be in any namespace
+			namespace = "*"
+		}
+		w.watchAllIntentions(namespace)
+	default:
+		w.watchServiceIntentions(true, w.serviceName, w.namespace, w.serviceIntentions)
+	}
+}
+
+// watchAllIntentions keeps the list of all the intentions of namespace up to
+// date, the ones applying to the proxied services being picked by
+// listedIntentions
+func (w *Watcher) watchAllIntentions(namespace string) {
+	w.log.Infof("consul: watching intentions")
+
+	var lastIndex uint64
+	first := true
+	for {
+		var intentions []*intention
+		meta, err := w.consul.Raw().Query("/v1/connect/intentions", &intentions, &api.QueryOptions{
+			Namespace: namespace,
+			WaitIndex: lastIndex,
+			WaitTime:  10 * time.Minute,
+		})
+		if err != nil {
+			w.log.Errorf("consul: error fetching intentions: %s", err)
+			time.Sleep(errorWaitTime)
+			lastIndex = 0
+			continue
+		}
+
+		changed := lastIndex != meta.LastIndex
+		lastIndex = meta.LastIndex
+
+		if changed {
+			w.log.Debugf("consul: intentions changed")
+			w.lock.Lock()
+			w.intentions = intentions
+			w.lock.Unlock()
+			w.notifyChanged()
+		}
+
+		if first {
+			w.ready.Done()
+			first = false
+		}
+	}
+}
+
+// watchServiceIntentions keeps si up to date with the intentions matching the
+// destination service in namespace, until si is done
+func (w *Watcher) watchServiceIntentions(startup bool, service, namespace string, si *serviceIntentions) {
+	w.log.Infof("consul: watching intentions of %s", service)
+
+	index := uint64(0)
+	first := true
+	for {
+		if si.done {
+			return
+		}
+		var matches map[string][]*intention
+		meta, err := w.http.Query("/v1/connect/intentions/match", url.Values{
+			"by":   []string{"destination"},
+			"name": []string{service},
+		}, &matches, &api.QueryOptions{
+			Namespace: namespace,
+			WaitIndex: index,
+			WaitTime:  10 * time.Minute,
+		})
+		if err != nil {
+			w.log.Errorf("consul: error fetching intentions of %s: %s", service, err)
+			time.Sleep(errorWaitTime)
+			index = 0
+			continue
+		}
+
+		changed := index != meta.LastIndex
+		index = meta.LastIndex
+
+		if changed {
+			w.log.Debugf("consul: intentions of %s changed", service)
+			w.lock.Lock()
+			si.Intentions = matches[service]
+			w.lock.Unlock()
+			w.notifyChanged()
+		}
+
+		if startup && first {
+			w.ready.Done()
+		}
+		first = false
+	}
+}
+
+// genIntentions returns the intentions applying to the proxied services, or
+// all of them when only watching intentions, sorted by decreasing precedence
+func (w *Watcher) genIntentions() []Intention {
+	var intentions []*intention
+	switch {
+	case w.http == nil || w.intentionsOnly:
+		intentions = w.listedIntentions()
+	case w.gateway == GatewayTerminating:
+		// intentions on wildcard destinations match all services
+		seen := map[string]bool{}
+		for _, s := range w.terminating {
+			for _, i := range s.Intentions.Intentions {
+				if !seen[i.ID] {
+					seen[i.ID] = true
+					intentions = append(intentions, i)
+				}
+			}
+		}
+	case w.gateway == "":
+		intentions = w.serviceIntentions.Intentions
+	}
+
+	var res []Intention
+	for _, i := range intentions {
+		in := Intention{
+			SourcePartition: i.SourcePartition,
+			SourceNS:        i.SourceNS,
+			SourceName:      i.SourceName,
+			DestinationNS:   i.DestinationNS,
+			DestinationName: i.DestinationName,
+			Allow:           i.Action == api.IntentionActionAllow,
+			Precedence:      i.Precedence,
+		}
+		for _, p := range i.Permissions {
+			perm := IntentionPermission{
+				Allow: p.Action == string(api.IntentionActionAllow),
+			}
+			if p.HTTP != nil {
+				perm.HTTP = &IntentionHTTPPermission{
+					PathExact:  p.HTTP.PathExact,
+					PathPrefix: p.HTTP.PathPrefix,
+					PathRegex:  p.HTTP.PathRegex,
+					Methods:    p.HTTP.Methods,
+				}
+				for _, h := range p.HTTP.Header {
+					perm.HTTP.Headers = append(perm.HTTP.Headers, UpstreamHeaderMatch(h))
+				}
+			}
+			in.Permissions = append(in.Permissions, perm)
+		}
+		res = append(res, in)
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].Precedence != res[j].Precedence {
+			return res[i].Precedence > res[j].Precedence
+		}
+		if res[i].SourceName != res[j].SourceName {
+			return res[i].SourceName < res[j].SourceName
+		}
+		return res[i].DestinationName < res[j].DestinationName
+	})
+
+	return res
+}
+
+// listedIntentions returns the intentions of the list of all of them applying
+// to the proxied services, or all of them when only watching intentions
+func (w *Watcher) listedIntentions() []*intention {
+	if w.intentionsOnly {
+		return w.intentions
+	}
+
+	namespace := w.namespace
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+
+	// destinations are indexed by namespace and name, as are the services
+	// linked to terminating gateways
+	destinations := map[string]bool{}
+	switch w.gateway {
+	case "":
+		destinations[namespace+"/"+w.serviceName] = true
+	case GatewayTerminating:
+		for key := range w.terminating {
+			destinations[key] = true
+		}
+	}
+
+	var res []*intention
+	for _, i := range w.intentions {
+		for d := range destinations {
+			if intentionDestinationMatch(i, d) {
+				res = append(res, i)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// intentionDestinationMatch returns whether the destination of i matches
+// the service destination, given as namespace/name
+func intentionDestinationMatch(i *intention, destination string) bool {
+	parts := strings.SplitN(destination, "/", 2)
+	return intentionNameMatch(i.DestinationNS, parts[0]) && intentionNameMatch(i.DestinationName, parts[1])
+}
+
+func intentionNameMatch(pattern, name string) bool {
+	return pattern == "" || pattern == "*" || pattern == name
+}
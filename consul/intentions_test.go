@@ -0,0 +1,80 @@
+package consul
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchServiceIntentions(t *testing.T) {
+	stop := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/connect/intentions/match", r.URL.Path)
+		require.Equal(t, "destination", r.URL.Query().Get("by"))
+		require.Equal(t, "web", r.URL.Query().Get("name"))
+		if r.URL.Query().Get("index") != "" {
+			// block until the end of the test
+			<-stop
+		}
+		w.Header().Set("X-Consul-Index", "7")
+		w.Write([]byte(`{"web": [
+			{"ID": "1", "SourceName": "api", "DestinationName": "web", "Action": "allow", "Precedence": 9},
+			{"ID": "2", "SourceName": "*", "DestinationName": "web", "Precedence": 8, "Permissions": [
+				{"Action": "deny", "HTTP": {"PathPrefix": "/admin", "Methods": ["POST"]}}
+			]}
+		]}`))
+	}))
+	defer srv.Close()
+	defer close(stop)
+
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	w := New("web-inst", nil, NewTestingLogger(t))
+	w.serviceName = "web"
+	w.SetHTTPClient(&HTTPClient{
+		Client:  srv.Client(),
+		Scheme:  u.Scheme,
+		Address: u.Host,
+	})
+
+	w.ready.Add(1)
+	go w.watchIntentions()
+	w.ready.Wait()
+	defer func() {
+		w.lock.Lock()
+		w.serviceIntentions.done = true
+		w.lock.Unlock()
+	}()
+
+	w.lock.Lock()
+	intentions := w.genIntentions()
+	w.lock.Unlock()
+
+	require.Equal(t, []Intention{
+		{
+			SourceName:      "api",
+			DestinationName: "web",
+			Allow:           true,
+			Precedence:      9,
+		},
+		{
+			SourceName:      "*",
+			DestinationName: "web",
+			Precedence:      8,
+			Permissions: []IntentionPermission{
+				{
+					HTTP: &IntentionHTTPPermission{
+						PathPrefix: "/admin",
+						Methods:    []string{"POST"},
+					},
+				},
+			},
+		},
+	}, intentions)
+	require.Equal(t, api.IntentionActionAllow, w.serviceIntentions.Intentions[0].Action)
+}
@@ -0,0 +1,73 @@
+package consul
+
+import (
+	"fmt"
+	"time"
+)
+
+// parseLimits parses the limits upstream config, an object with the
+// max_connections, max_pending_requests and queue_timeout keys
+func parseLimits(v interface{}) (*UpstreamLimits, error) {
+	config, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid limits %v", v)
+	}
+
+	l := &UpstreamLimits{}
+	for key, dst := range map[string]*int{
+		"max_connections":      &l.MaxConnections,
+		"max_pending_requests": &l.MaxPendingRequests,
+	} {
+		switch n := config[key].(type) {
+		case nil:
+		case float64:
+			*dst = int(n)
+		case int:
+			*dst = n
+		default:
+			return nil, fmt.Errorf("invalid %s %v", key, n)
+		}
+		if *dst < 0 {
+			return nil, fmt.Errorf("invalid %s %d", key, *dst)
+		}
+	}
+
+	switch t := config["queue_timeout"].(type) {
+	case nil:
+	case string:
+		d, err := time.ParseDuration(t)
+		if err != nil {
+			return nil, fmt.Errorf("invalid queue_timeout: %s", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid queue_timeout %s", t)
+		}
+		l.QueueTimeout = d
+	default:
+		return nil, fmt.Errorf("invalid queue_timeout %v", t)
+	}
+
+	if l.MaxConnections == 0 && (l.MaxPendingRequests != 0 || l.QueueTimeout != 0) {
+		return nil, fmt.Errorf("max_pending_requests and queue_timeout require max_connections")
+	}
+
+	return l, nil
+}
+
+// upstreamLimits returns the limits of up, nil when unlimited
+func (w *Watcher) upstreamLimits(up *upstream) *UpstreamLimits {
+	v, ok := w.configValue("limits", up.Config, "")
+	if !ok {
+		return nil
+	}
+
+	l, err := parseLimits(v)
+	if err != nil {
+		w.log.Errorf("upstream %s: bad limits value in config: %s. Disabling them", up.Name, err)
+		return nil
+	}
+	if l.MaxConnections == 0 {
+		return nil
+	}
+	return l
+}
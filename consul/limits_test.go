@@ -0,0 +1,33 @@
+package consul
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLimits(t *testing.T) {
+	l, err := parseLimits(map[string]interface{}{
+		"max_connections":      float64(100),
+		"max_pending_requests": float64(10),
+		"queue_timeout":        "2s",
+	})
+	require.NoError(t, err)
+	require.Equal(t, &UpstreamLimits{
+		MaxConnections:     100,
+		MaxPendingRequests: 10,
+		QueueTimeout:       2 * time.Second,
+	}, l)
+
+	for _, c := range []interface{}{
+		"100",
+		map[string]interface{}{"max_connections": float64(-1)},
+		map[string]interface{}{"max_connections": "many"},
+		map[string]interface{}{"max_pending_requests": float64(10)},
+		map[string]interface{}{"max_connections": float64(1), "queue_timeout": "soon"},
+	} {
+		_, err := parseLimits(c)
+		require.Error(t, err, c)
+	}
+}
@@ -0,0 +1,179 @@
+package consul
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Load balancing algorithms of upstreams, named after the HAProxy ones
+const (
+	BalanceRoundRobin = "roundrobin"
+	BalanceLeastConn  = "leastconn"
+	BalanceRandom     = "random"
+	BalanceFirst      = "first"
+	BalanceSource     = "source"
+	// BalanceHdr and BalanceURLParam consistently hash a request header or
+	// url parameter
+	BalanceHdr      = "hdr"
+	BalanceURLParam = "url_param"
+)
+
+var balanceArgRe = regexp.MustCompile(`^(hdr|url_param)\(([^()]+)\)$`)
+
+// serviceResolverConfigEntry decodes only the name and the load balancer of
+// the service-resolver config entries
+type serviceResolverConfigEntry struct {
+	Name         string
+	LoadBalancer *loadBalancer
+}
+
+type loadBalancer struct {
+	Policy       string
+	HashPolicies []hashPolicy
+}
+
+type hashPolicy struct {
+	Field      string
+	FieldValue string
+	SourceIP   bool
+}
+
+// parseBalance parses the balance upstream config, an algorithm with the
+// header or url parameter to hash in parentheses for hdr and url_param
+func parseBalance(s string) (UpstreamBalance, error) {
+	switch s {
+	case BalanceRoundRobin, BalanceLeastConn, BalanceRandom, BalanceFirst, BalanceSource:
+		return UpstreamBalance{Algorithm: s}, nil
+	}
+
+	m := balanceArgRe.FindStringSubmatch(s)
+	if m == nil {
+		return UpstreamBalance{}, fmt.Errorf("unknown algorithm %s", s)
+	}
+	if m[1] == BalanceHdr {
+		return UpstreamBalance{Algorithm: BalanceHdr, HdrName: m[2]}, nil
+	}
+	return UpstreamBalance{Algorithm: BalanceURLParam, URLParam: m[2]}, nil
+}
+
+// resolverBalance converts the load balancer of a service-resolver. Hashing
+// policies use the first field HAProxy can hash. HAProxy cannot hash a single
+// cookie, cookie policies hash the whole Cookie header instead.
+func resolverBalance(lb *loadBalancer) (UpstreamBalance, error) {
+	switch lb.Policy {
+	case "":
+		return UpstreamBalance{}, nil
+	case "round_robin":
+		return UpstreamBalance{Algorithm: BalanceRoundRobin}, nil
+	case "least_request":
+		return UpstreamBalance{Algorithm: BalanceLeastConn}, nil
+	case "random":
+		return UpstreamBalance{Algorithm: BalanceRandom}, nil
+	case "ring_hash", "maglev":
+	default:
+		return UpstreamBalance{}, fmt.Errorf("unknown policy %s", lb.Policy)
+	}
+
+	for _, p := range lb.HashPolicies {
+		switch {
+		case p.SourceIP:
+			return UpstreamBalance{Algorithm: BalanceSource}, nil
+		case p.Field == "header":
+			return UpstreamBalance{Algorithm: BalanceHdr, HdrName: p.FieldValue}, nil
+		case p.Field == "query_parameter":
+			return UpstreamBalance{Algorithm: BalanceURLParam, URLParam: p.FieldValue}, nil
+		case p.Field == "cookie":
+			return UpstreamBalance{Algorithm: BalanceHdr, HdrName: "Cookie"}, nil
+		}
+	}
+	return UpstreamBalance{}, fmt.Errorf("no supported hash policy for %s", lb.Policy)
+}
+
+// validate checks the algorithm can balance traffic of protocol
+func (b UpstreamBalance) validate(protocol string) error {
+	if protocol == "tcp" && (b.Algorithm == BalanceHdr || b.Algorithm == BalanceURLParam) {
+		return fmt.Errorf("%s requires an http protocol", b.Algorithm)
+	}
+	return nil
+}
+
+// upstreamBalance returns the load balancing of the instances of service
+// for up, from the balance config of up, the service-resolver of service or
+// the proxy defaults. It must be called with the lock held.
+func (w *Watcher) upstreamBalance(up *upstream, service, protocol string) UpstreamBalance {
+	var b UpstreamBalance
+	var err error
+	v, ok := w.configValue("balance", up.Config, "")
+	_, own := up.Config["balance"]
+	lb := w.serviceResolvers[service]
+	switch {
+	case lb != nil && !own:
+		// the service-resolver is more specific than the proxy defaults
+		b, err = resolverBalance(lb)
+	case ok:
+		s, isString := v.(string)
+		if !isString {
+			err = fmt.Errorf("invalid balance %v", v)
+			break
+		}
+		b, err = parseBalance(s)
+	}
+	if err == nil {
+		err = b.validate(protocol)
+	}
+	if err != nil {
+		w.log.Errorf("upstream %s: bad load balancing of %s: %s. Using default", up.Name, service, err)
+		return UpstreamBalance{}
+	}
+	return b
+}
+
+// watchServiceResolvers watches the load balancers of the service-resolver
+// config entries
+func (w *Watcher) watchServiceResolvers() {
+	w.log.Infof("consul: watching %s config entries", api.ServiceResolver)
+
+	var lastIndex uint64
+	first := true
+	for {
+		var entries []serviceResolverConfigEntry
+		meta, err := w.consul.Raw().Query("/v1/config/"+api.ServiceResolver, &entries, &api.QueryOptions{
+			WaitIndex: lastIndex,
+			WaitTime:  10 * time.Minute,
+		})
+		if err != nil {
+			w.log.Errorf("consul: error fetching %s config entries: %s", api.ServiceResolver, err)
+			time.Sleep(errorWaitTime)
+			lastIndex = 0
+			continue
+		}
+
+		changed := lastIndex != meta.LastIndex
+		lastIndex = meta.LastIndex
+
+		if changed {
+			resolvers := map[string]*loadBalancer{}
+			for _, e := range entries {
+				if e.LoadBalancer != nil {
+					resolvers[e.Name] = e.LoadBalancer
+				}
+			}
+
+			w.lock.Lock()
+			w.serviceResolvers = resolvers
+			for _, u := range w.upstreams {
+				w.updateUpstreamBalances(u)
+			}
+			w.lock.Unlock()
+			w.notifyChanged()
+		}
+
+		if first {
+			w.ready.Done()
+			first = false
+		}
+	}
+}
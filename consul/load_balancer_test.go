@@ -0,0 +1,81 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBalance(t *testing.T) {
+	for s, expected := range map[string]UpstreamBalance{
+		"roundrobin":     {Algorithm: BalanceRoundRobin},
+		"source":         {Algorithm: BalanceSource},
+		"hdr(X-User)":    {Algorithm: BalanceHdr, HdrName: "X-User"},
+		"url_param(uid)": {Algorithm: BalanceURLParam, URLParam: "uid"},
+	} {
+		b, err := parseBalance(s)
+		require.NoError(t, err, s)
+		require.Equal(t, expected, b, s)
+	}
+
+	for _, s := range []string{"", "least_request", "hdr()", "cookie(id)"} {
+		_, err := parseBalance(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestResolverBalance(t *testing.T) {
+	b, err := resolverBalance(&loadBalancer{Policy: "least_request"})
+	require.NoError(t, err)
+	require.Equal(t, UpstreamBalance{Algorithm: BalanceLeastConn}, b)
+
+	b, err = resolverBalance(&loadBalancer{
+		Policy: "ring_hash",
+		HashPolicies: []hashPolicy{
+			{Field: "path"},
+			{Field: "header", FieldValue: "X-User"},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, UpstreamBalance{Algorithm: BalanceHdr, HdrName: "X-User"}, b)
+
+	// the whole Cookie header is hashed
+	b, err = resolverBalance(&loadBalancer{
+		Policy:       "maglev",
+		HashPolicies: []hashPolicy{{Field: "cookie", FieldValue: "session"}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, UpstreamBalance{Algorithm: BalanceHdr, HdrName: "Cookie"}, b)
+
+	_, err = resolverBalance(&loadBalancer{
+		Policy:       "maglev",
+		HashPolicies: []hashPolicy{{Field: "path"}},
+	})
+	require.Error(t, err)
+}
+
+func TestUpstreamBalance(t *testing.T) {
+	w := &Watcher{
+		log: NewTestingLogger(t),
+		serviceResolvers: map[string]*loadBalancer{
+			"web": {Policy: "random"},
+		},
+	}
+
+	require.Equal(t, UpstreamBalance{Algorithm: BalanceRandom}, w.upstreamBalance(&upstream{}, "web", "http"))
+	require.Equal(t, UpstreamBalance{Algorithm: BalanceFirst}, w.upstreamBalance(&upstream{
+		Config: map[string]interface{}{"balance": "first"},
+	}, "web", "http"))
+	// header hashing is not possible in tcp
+	require.Equal(t, UpstreamBalance{}, w.upstreamBalance(&upstream{
+		Config: map[string]interface{}{"balance": "hdr(X-User)"},
+	}, "web", "tcp"))
+
+	// the proxy defaults apply to the services without service-resolver
+	w.proxyDefaults = &api.ProxyConfigEntry{
+		Config: map[string]interface{}{"balance": "roundrobin"},
+	}
+	require.Equal(t, UpstreamBalance{Algorithm: BalanceRandom}, w.upstreamBalance(&upstream{}, "web", "http"))
+	require.Equal(t, UpstreamBalance{Algorithm: BalanceRoundRobin}, w.upstreamBalance(&upstream{}, "db", "http"))
+}
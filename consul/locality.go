@@ -0,0 +1,102 @@
+package consul
+
+import (
+	"strconv"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// DefaultLocalityMinHealthy is the number of instances in the local zone
+// under which the instances of other zones are used as well
+const DefaultLocalityMinHealthy = 1
+
+// locality prefers the instances in the zone of the local agent, read from
+// the Key service or node metadata, to the ones in other zones which are
+// only used as backups. Other zones are used as well when less than
+// MinHealthy instances are available locally. The zero value disables it.
+type locality struct {
+	Key        string
+	Zone       string
+	MinHealthy int
+}
+
+// upstreamLocality reads the locality_key and locality_min_healthy settings
+// of up
+func (w *Watcher) upstreamLocality(up *upstream) locality {
+	v, _ := w.configValue("locality_key", up.Config, "")
+	key, _ := v.(string)
+	if key == "" {
+		return locality{}
+	}
+
+	zone := w.nodeMeta[key]
+	if zone == "" {
+		w.log.Warnf("upstream %s: local agent has no %s metadata, ignoring locality", up.Name, key)
+		return locality{}
+	}
+
+	l := locality{
+		Key:        key,
+		Zone:       zone,
+		MinHealthy: DefaultLocalityMinHealthy,
+	}
+
+	v, ok := w.configValue("locality_min_healthy", up.Config, "")
+	if !ok {
+		return l
+	}
+	switch m := v.(type) {
+	case float64:
+		l.MinHealthy = int(m)
+	case int:
+		l.MinHealthy = m
+	case string:
+		n, err := strconv.Atoi(m)
+		if err != nil {
+			w.log.Errorf("upstream %s: bad locality_min_healthy value in config: %s. Using default: %d", up.Name, err, DefaultLocalityMinHealthy)
+			break
+		}
+		l.MinHealthy = n
+	default:
+		w.log.Errorf("upstream %s: bad locality_min_healthy value in config: %v. Using default: %d", up.Name, v, DefaultLocalityMinHealthy)
+	}
+
+	return l
+}
+
+// local returns whether the instance s is in the local zone, the service
+// metadata taking precedence over the node one
+func (l locality) local(s *api.ServiceEntry) bool {
+	if l.Key == "" {
+		return true
+	}
+	if z, ok := s.Service.Meta[l.Key]; ok {
+		return z == l.Zone
+	}
+	if s.Node != nil {
+		return s.Node.Meta[l.Key] == l.Zone
+	}
+	return false
+}
+
+// markBackups marks the nodes outside of the local zone as backups, unless
+// there are not enough local ones. entries are the instances of nodes.
+func (l locality) markBackups(nodes []UpstreamNode, entries []*api.ServiceEntry) {
+	if l.Key == "" {
+		return
+	}
+
+	count := 0
+	for _, e := range entries {
+		if l.local(e) {
+			count++
+		}
+	}
+	if count < l.MinHealthy {
+		return
+	}
+
+	for i := range nodes {
+		nodes[i].Backup = !l.local(entries[i])
+	}
+}
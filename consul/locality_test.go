@@ -0,0 +1,73 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func localityEntry(host, nodeZone, serviceZone string) *api.ServiceEntry {
+	e := &api.ServiceEntry{
+		Node: &api.Node{Node: host, Address: host, Meta: map[string]string{"zone": nodeZone}},
+		Service: &api.AgentService{
+			Port:    8080,
+			Weights: api.AgentWeights{Passing: 1, Warning: 1},
+		},
+	}
+	if serviceZone != "" {
+		e.Service.Meta = map[string]string{"zone": serviceZone}
+	}
+	return e
+}
+
+func TestUpstreamLocality(t *testing.T) {
+	w := &Watcher{
+		log:      NewTestingLogger(t),
+		nodeMeta: map[string]string{"zone": "a"},
+	}
+
+	entries := []*api.ServiceEntry{
+		localityEntry("1.1.1.1", "a", ""),
+		localityEntry("1.1.1.2", "b", ""),
+		localityEntry("1.1.1.3", "b", "a"),
+	}
+
+	for _, tc := range []struct {
+		name     string
+		config   map[string]interface{}
+		expected []bool
+	}{
+		{
+			name:     "disabled",
+			config:   nil,
+			expected: []bool{false, false, false},
+		},
+		{
+			name:     "zone",
+			config:   map[string]interface{}{"locality_key": "zone"},
+			expected: []bool{false, true, false},
+		},
+		{
+			name:     "spill over",
+			config:   map[string]interface{}{"locality_key": "zone", "locality_min_healthy": float64(3)},
+			expected: []bool{false, false, false},
+		},
+		{
+			name:     "unknown key",
+			config:   map[string]interface{}{"locality_key": "rack"},
+			expected: []bool{false, false, false},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var alive, total int
+			up := &upstream{Name: "up", Config: tc.config}
+			w.updateUpstreamSettings(up)
+			nodes := w.genUpstreamNodes(entries, up, &alive, &total)
+			require.Len(t, nodes, len(tc.expected))
+			for i, backup := range tc.expected {
+				require.Equal(t, backup, nodes[i].Backup, nodes[i].Host)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package consul
+
+import (
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Login holds an ACL token obtained by exchanging a bearer token, such as a
+// kubernetes service account JWT, through an ACL auth method
+type Login struct {
+	client          *api.Client
+	authMethod      string
+	bearerTokenFile string
+	log             Logger
+
+	lock  sync.Mutex
+	token string
+}
+
+// NewLogin logs in with the bearer token in bearerTokenFile, using a client
+// which must not be configured with the resulting token
+func NewLogin(client *api.Client, authMethod, bearerTokenFile string, log Logger) (*Login, error) {
+	l := &Login{
+		client:          client,
+		authMethod:      authMethod,
+		bearerTokenFile: bearerTokenFile,
+		log:             log,
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	err := l.login()
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// login must be called with the lock held. The bearer token is read again as
+// it can be rotated.
+func (l *Login) login() error {
+	b, err := ioutil.ReadFile(l.bearerTokenFile)
+	if err != nil {
+		return err
+	}
+
+	token, _, err := l.client.ACL().Login(&api.ACLLoginParams{
+		AuthMethod:  l.authMethod,
+		BearerToken: strings.TrimSpace(string(b)),
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	l.log.Infof("consul: logged in with auth method %s, token accessor %s", l.authMethod, token.AccessorID)
+	l.token = token.SecretID
+	return nil
+}
+
+// Token returns the current token
+func (l *Login) Token() string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.token
+}
+
+// Refresh logs in again unless the rejected token was already replaced
+func (l *Login) Refresh(rejected string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.token != rejected {
+		return true
+	}
+
+	l.log.Infof("consul: token rejected, logging in again with auth method %s", l.authMethod)
+	err := l.login()
+	if err != nil {
+		l.log.Errorf("consul: error logging in with auth method %s: %s", l.authMethod, err)
+		return false
+	}
+	return true
+}
+
+// Logout destroys the current token
+func (l *Login) Logout() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	_, err := l.client.ACL().Logout(&api.WriteOptions{
+		Token: l.token,
+	})
+	return err
+}
@@ -0,0 +1,372 @@
+package consul
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/agent/connect"
+	"github.com/hashicorp/consul/api"
+)
+
+// meshPollInterval is the interval at which the datacenters and namespaces
+// are listed, their endpoints not supporting blocking queries
+const meshPollInterval = time.Minute
+
+// meshEndpoint is a local service or a remote datacenter a mesh gateway
+// routes to
+type meshEndpoint struct {
+	Name       string
+	Namespace  string
+	Datacenter string
+	Nodes      []*api.ServiceEntry
+
+	done bool
+}
+
+// meshNamespace holds the local services of a namespace, whose Name is empty
+// when consul does not support namespaces
+type meshNamespace struct {
+	Name     string
+	Services map[string]*meshEndpoint
+
+	done bool
+}
+
+// watchMeshServices watches the local services of all the namespaces to route
+// to their connect enabled instances
+func (w *Watcher) watchMeshServices() {
+	w.log.Infof("consul: watching local services")
+
+	first := true
+	for {
+		names, err := w.listNamespaces()
+		if err != nil {
+			w.log.Errorf("consul: error fetching namespaces: %s", err)
+			time.Sleep(errorWaitTime)
+			continue
+		}
+
+		w.lock.Lock()
+		changed := false
+		for name := range names {
+			if _, ok := w.meshNamespaces[name]; ok {
+				continue
+			}
+			ns := &meshNamespace{
+				Name:     name,
+				Services: map[string]*meshEndpoint{},
+			}
+			w.meshNamespaces[name] = ns
+			w.startMeshNamespace(first, ns)
+		}
+		for name, ns := range w.meshNamespaces {
+			if names[name] {
+				continue
+			}
+			w.log.Infof("consul: removing namespace %s", name)
+			ns.done = true
+			w.setMeshEndpoints(false, ns.Services, nil, nil)
+			delete(w.meshNamespaces, name)
+			changed = true
+		}
+		w.lock.Unlock()
+		if changed {
+			w.notifyChanged()
+		}
+
+		if first {
+			w.ready.Done()
+			first = false
+		}
+
+		time.Sleep(meshPollInterval)
+	}
+}
+
+// listNamespaces returns the names of the namespaces, or only the empty name
+// when consul does not support them
+func (w *Watcher) listNamespaces() (map[string]bool, error) {
+	namespaces, _, err := w.consul.Namespaces().List(nil)
+	if err != nil {
+		// the namespace endpoints only exist in consul enterprise
+		if strings.Contains(err.Error(), "404") {
+			return map[string]bool{"": true}, nil
+		}
+		return nil, err
+	}
+
+	names := map[string]bool{}
+	for _, ns := range namespaces {
+		names[ns.Name] = true
+	}
+	return names, nil
+}
+
+// startMeshNamespace watches the services of ns, to start watching their
+// instances
+func (w *Watcher) startMeshNamespace(startup bool, ns *meshNamespace) {
+	w.log.Infof("consul: watching local services in namespace %s", ns.Name)
+
+	// the gateway is only excluded from its own namespace
+	gatewayNamespace := ""
+	if ns.Name != "" {
+		gatewayNamespace = w.namespace
+		if gatewayNamespace == "" {
+			gatewayNamespace = DefaultNamespace
+		}
+	}
+
+	if startup {
+		w.ready.Add(1)
+	}
+
+	go func() {
+		var lastIndex uint64
+		first := true
+		for {
+			if ns.done {
+				return
+			}
+			services, meta, err := w.consul.Catalog().Services(&api.QueryOptions{
+				Namespace: ns.Name,
+				WaitIndex: lastIndex,
+				WaitTime:  10 * time.Minute,
+			})
+			if err != nil {
+				w.log.Errorf("consul: error fetching services in namespace %s: %s", ns.Name, err)
+				time.Sleep(errorWaitTime)
+				lastIndex = 0
+				continue
+			}
+
+			changed := lastIndex != meta.LastIndex
+			lastIndex = meta.LastIndex
+
+			if changed {
+				names := map[string]bool{}
+				for name := range services {
+					if name == "consul" || (name == w.serviceName && ns.Name == gatewayNamespace) {
+						continue
+					}
+					names[name] = true
+				}
+
+				w.lock.Lock()
+				if !ns.done {
+					changed = w.setMeshEndpoints(startup && first, ns.Services, names, func(name string) *meshEndpoint {
+						return &meshEndpoint{
+							Name:       name,
+							Namespace:  ns.Name,
+							Datacenter: w.datacenter,
+						}
+					})
+				}
+				w.lock.Unlock()
+				if changed {
+					w.notifyChanged()
+				}
+			}
+
+			if startup && first {
+				w.ready.Done()
+			}
+
+			first = false
+		}
+	}()
+}
+
+// watchMeshDatacenters watches the remote datacenters to route to their mesh
+// gateways, registered with the service name of the local one unless the
+// mesh_gateway_service proxy config sets another one
+func (w *Watcher) watchMeshDatacenters() {
+	w.log.Infof("consul: watching datacenters")
+
+	first := true
+	for {
+		dcs, err := w.consul.Catalog().Datacenters()
+		if err != nil {
+			w.log.Errorf("consul: error fetching datacenters: %s", err)
+			time.Sleep(errorWaitTime)
+			continue
+		}
+
+		names := map[string]bool{}
+		for _, dc := range dcs {
+			if dc != w.datacenter {
+				names[dc] = true
+			}
+		}
+
+		w.lock.Lock()
+		service := w.serviceName
+		if s, ok := w.downstream.Config["mesh_gateway_service"].(string); ok && s != "" {
+			service = s
+		}
+		changed := w.setMeshEndpoints(first, w.meshDatacenters, names, func(dc string) *meshEndpoint {
+			return &meshEndpoint{
+				Name:       service,
+				Datacenter: dc,
+			}
+		})
+		w.lock.Unlock()
+		if changed {
+			w.notifyChanged()
+		}
+
+		if first {
+			w.ready.Done()
+			first = false
+		}
+
+		time.Sleep(meshPollInterval)
+	}
+}
+
+// setMeshEndpoints starts watching the endpoints in names missing from
+// endpoints or changed, and stops the ones not in names anymore. It returns
+// whether endpoints changed, and must be called with the lock held.
+func (w *Watcher) setMeshEndpoints(startup bool, endpoints map[string]*meshEndpoint, names map[string]bool, newEndpoint func(name string) *meshEndpoint) bool {
+	changed := false
+	for name := range names {
+		e := newEndpoint(name)
+		if old, ok := endpoints[name]; ok {
+			if old.Name == e.Name && old.Datacenter == e.Datacenter {
+				continue
+			}
+			old.done = true
+		}
+		endpoints[name] = e
+		w.startMeshEndpoint(startup, e)
+		changed = true
+	}
+
+	for name, e := range endpoints {
+		if !names[name] {
+			w.log.Infof("consul: removing mesh endpoint %s in %s", e.Name, e.Datacenter)
+			e.done = true
+			delete(endpoints, name)
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (w *Watcher) startMeshEndpoint(startup bool, e *meshEndpoint) {
+	w.log.Infof("consul: watching mesh endpoint %s in %s", e.Name, e.Datacenter)
+
+	remote := e.Datacenter != w.datacenter
+
+	if startup {
+		w.ready.Add(1)
+	}
+
+	go func() {
+		index := uint64(0)
+		first := true
+		for {
+			if e.done {
+				return
+			}
+			q := &api.QueryOptions{
+				Namespace:  e.Namespace,
+				Datacenter: e.Datacenter,
+				WaitTime:   10 * time.Minute,
+				WaitIndex:  index,
+			}
+			var nodes []*api.ServiceEntry
+			var meta *api.QueryMeta
+			var err error
+			if remote {
+				// only the mesh gateways, should the name be shared
+				q.Filter = fmt.Sprintf("Service.Kind == %q", api.ServiceKindMeshGateway)
+				nodes, meta, err = w.consul.Health().Service(e.Name, "", true, q)
+			} else {
+				nodes, meta, err = w.consul.Health().Connect(e.Name, "", true, q)
+			}
+			if err != nil {
+				w.log.Errorf("consul: error fetching service definition for %s in %s: %s", e.Name, e.Datacenter, err)
+				time.Sleep(errorWaitTime)
+				index = 0
+				continue
+			}
+			changed := index != meta.LastIndex
+			index = meta.LastIndex
+
+			if changed {
+				w.lock.Lock()
+				e.Nodes = nodes
+				w.lock.Unlock()
+				w.notifyChanged()
+			}
+
+			if startup && first {
+				w.ready.Done()
+			}
+
+			first = false
+		}
+	}()
+}
+
+func (w *Watcher) genMeshGatewayRoutes(alive, total *int) []MeshGatewayRoute {
+	connectTimeout := w.downstream.ConnectTimeout
+
+	var local, remote []MeshGatewayRoute
+	for _, n := range w.meshNamespaces {
+		ns := n.Name
+		if ns == "" {
+			ns = DefaultNamespace
+		}
+		for name, e := range n.Services {
+			nodes := w.genUpstreamNodes(e.Nodes, nil, alive, total)
+			if len(nodes) == 0 {
+				continue
+			}
+			local = append(local, MeshGatewayRoute{
+				Name:           name,
+				Namespace:      ns,
+				SNI:            connect.ServiceSNI(name, "", ns, w.datacenter, w.trustDomain),
+				ConnectTimeout: connectTimeout,
+				Nodes:          nodes,
+			})
+		}
+	}
+	for dc, e := range w.meshDatacenters {
+		nodes := w.genUpstreamNodes(wanServiceEntries(e.Nodes), nil, alive, total)
+		if len(nodes) == 0 {
+			continue
+		}
+		remote = append(remote, MeshGatewayRoute{
+			Name:           dc,
+			SNI:            fmt.Sprintf(".%s.internal.%s", dc, w.trustDomain),
+			Remote:         true,
+			ConnectTimeout: connectTimeout,
+			Nodes:          nodes,
+		})
+	}
+
+	sort.Slice(local, func(i, j int) bool {
+		if local[i].Namespace != local[j].Namespace {
+			return local[i].Namespace < local[j].Namespace
+		}
+		return local[i].Name < local[j].Name
+	})
+	sort.Slice(remote, func(i, j int) bool {
+		return remote[i].Name < remote[j].Name
+	})
+
+	return append(local, remote...)
+}
+
+// wanServiceEntries returns copies of nodes using their wan address when
+// they have one
+func wanServiceEntries(nodes []*api.ServiceEntry) []*api.ServiceEntry {
+	res := make([]*api.ServiceEntry, 0, len(nodes))
+	for _, n := range nodes {
+		res = append(res, wanServiceEntry(n))
+	}
+	return res
+}
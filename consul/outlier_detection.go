@@ -0,0 +1,93 @@
+package consul
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	ObserveLayer4 = "layer4"
+	ObserveLayer7 = "layer7"
+
+	DefaultOutlierConsecutiveErrors = 5
+	DefaultOutlierInterval          = 10 * time.Second
+)
+
+// parseOutlierDetection parses the outlier_detection upstream config, an
+// object with the observe, consecutive_errors and interval keys. Errors are
+// observed at the application layer for http upstreams by default.
+func parseOutlierDetection(v interface{}, protocol string) (*OutlierDetection, error) {
+	config, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid outlier_detection %v", v)
+	}
+
+	od := &OutlierDetection{
+		Observe:           ObserveLayer7,
+		ConsecutiveErrors: DefaultOutlierConsecutiveErrors,
+		Interval:          DefaultOutlierInterval,
+	}
+	if protocol == "tcp" {
+		od.Observe = ObserveLayer4
+	}
+
+	switch o := config["observe"].(type) {
+	case nil:
+	case string:
+		if o != ObserveLayer4 && o != ObserveLayer7 {
+			return nil, fmt.Errorf("unknown observe layer %s", o)
+		}
+		if o == ObserveLayer7 && protocol == "tcp" {
+			return nil, fmt.Errorf("%s requires an http protocol", o)
+		}
+		od.Observe = o
+	default:
+		return nil, fmt.Errorf("invalid observe %v", o)
+	}
+
+	switch c := config["consecutive_errors"].(type) {
+	case nil:
+	case float64:
+		od.ConsecutiveErrors = int(c)
+	case int:
+		od.ConsecutiveErrors = c
+	default:
+		return nil, fmt.Errorf("invalid consecutive_errors %v", c)
+	}
+	if od.ConsecutiveErrors < 1 {
+		return nil, fmt.Errorf("invalid consecutive_errors %d", od.ConsecutiveErrors)
+	}
+
+	switch i := config["interval"].(type) {
+	case nil:
+	case string:
+		d, err := time.ParseDuration(i)
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval: %s", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid interval %s", i)
+		}
+		od.Interval = d
+	default:
+		return nil, fmt.Errorf("invalid interval %v", i)
+	}
+
+	return od, nil
+}
+
+// upstreamOutlierDetection returns the outlier detection of up, nil when
+// disabled
+func (w *Watcher) upstreamOutlierDetection(up *upstream, protocol string) *OutlierDetection {
+	v, ok := w.configValue("outlier_detection", up.Config, "")
+	if !ok {
+		return nil
+	}
+
+	od, err := parseOutlierDetection(v, protocol)
+	if err != nil {
+		w.log.Errorf("upstream %s: bad outlier_detection value in config: %s. Disabling it", up.Name, err)
+		return nil
+	}
+	return od
+}
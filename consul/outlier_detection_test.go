@@ -0,0 +1,39 @@
+package consul
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseOutlierDetection(t *testing.T) {
+	od, err := parseOutlierDetection(map[string]interface{}{}, "http")
+	require.NoError(t, err)
+	require.Equal(t, &OutlierDetection{
+		Observe:           ObserveLayer7,
+		ConsecutiveErrors: DefaultOutlierConsecutiveErrors,
+		Interval:          DefaultOutlierInterval,
+	}, od)
+
+	od, err = parseOutlierDetection(map[string]interface{}{
+		"consecutive_errors": float64(3),
+		"interval":           "2s",
+	}, "tcp")
+	require.NoError(t, err)
+	require.Equal(t, &OutlierDetection{
+		Observe:           ObserveLayer4,
+		ConsecutiveErrors: 3,
+		Interval:          2 * time.Second,
+	}, od)
+
+	for _, c := range []map[string]interface{}{
+		{"observe": "layer3"},
+		{"observe": "layer7"},
+		{"consecutive_errors": float64(0)},
+		{"interval": "often"},
+	} {
+		_, err := parseOutlierDetection(c, "tcp")
+		require.Error(t, err, c)
+	}
+}
@@ -0,0 +1,209 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const peeringPollInterval = time.Minute
+
+// agentServicePeers decodes the DestinationPeer of the upstreams from the
+// agent service definition of a proxy
+type agentServicePeers struct {
+	Proxy *struct {
+		Upstreams []struct {
+			DestinationPeer string
+		}
+	}
+}
+
+// peering mirrors the parts of a cluster peering we use
+type peering struct {
+	Name       string
+	PeerCAPems []string
+}
+
+// peeredServiceEntry holds the identity of a service imported from a peer
+type peeredServiceEntry struct {
+	Service struct {
+		Connect struct {
+			PeerMeta *struct {
+				SNI      []string
+				SpiffeID []string
+			}
+		}
+	}
+}
+
+// SetHTTPClient sets the client used for the requests the consul api cannot
+// make, which peered upstreams and the watch of the intentions matching the
+// proxied services require
+func (w *Watcher) SetHTTPClient(c *HTTPClient) {
+	w.http = c
+}
+
+// upstreamPeers returns the peers of the upstreams of the proxy service, in
+// the order of its upstreams
+func (w *Watcher) upstreamPeers(proxyID string) ([]string, error) {
+	var srv agentServicePeers
+	_, err := w.consul.Raw().Query("/v1/agent/service/"+url.PathEscape(proxyID), &srv, &api.QueryOptions{
+		Namespace: w.namespace,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error fetching the upstream peers of %s: %s", proxyID, err)
+	}
+	if srv.Proxy == nil {
+		return nil, nil
+	}
+
+	peers := make([]string, 0, len(srv.Proxy.Upstreams))
+	for _, up := range srv.Proxy.Upstreams {
+		peers = append(peers, up.DestinationPeer)
+	}
+	return peers, nil
+}
+
+// startUpstreamPeered watches an upstream imported from a peer cluster and
+// the trust bundle of the peer
+func (w *Watcher) startUpstreamPeered(startup bool, up api.Upstream, peer, name string) {
+	w.log.Infof("consul: watching upstream for service %s from peer %s", up.DestinationName, peer)
+
+	u := &upstream{
+		Name: name,
+		Peer: peer,
+	}
+
+	w.updateUpstream(up, u)
+
+	w.lock.Lock()
+	w.upstreams[name] = u
+	w.lock.Unlock()
+
+	if w.http == nil {
+		w.log.Errorf("consul: upstream %s: peered upstreams are not supported without an http client", name)
+		return
+	}
+
+	if startup {
+		w.ready.Add(2)
+	}
+
+	go func() {
+		index := uint64(0)
+		first := true
+		for {
+			if u.done {
+				return
+			}
+			var raw json.RawMessage
+			meta, err := w.http.Query("/v1/health/connect/"+url.PathEscape(up.DestinationName), url.Values{
+				"peer": []string{peer},
+			}, &raw, &api.QueryOptions{
+				Namespace: up.DestinationNamespace,
+				Filter:    u.Selector.filter(""),
+				NodeMeta:  u.Selector.NodeMeta,
+				WaitTime:  10 * time.Minute,
+				WaitIndex: index,
+			})
+			if err == nil {
+				err = w.setPeeredNodes(u, raw, index != meta.LastIndex)
+			}
+			if err != nil {
+				w.log.Errorf("consul: error fetching service definition for service %s from peer %s: %s", up.DestinationName, peer, err)
+				time.Sleep(errorWaitTime)
+				index = 0
+				continue
+			}
+			index = meta.LastIndex
+
+			if startup && first {
+				w.ready.Done()
+			}
+
+			first = false
+		}
+	}()
+
+	go func() {
+		first := true
+		for {
+			if u.done {
+				return
+			}
+			var p peering
+			_, err := w.consul.Raw().Query("/v1/peering/"+url.PathEscape(peer), &p, nil)
+			if err != nil {
+				w.log.Errorf("consul: error fetching trust bundle of peer %s: %s", peer, err)
+				time.Sleep(errorWaitTime)
+				continue
+			}
+
+			cas := make([][]byte, 0, len(p.PeerCAPems))
+			for _, ca := range p.PeerCAPems {
+				cas = append(cas, []byte(ca))
+			}
+			w.lock.Lock()
+			changed := !reflect.DeepEqual(u.PeerCAs, cas)
+			u.PeerCAs = cas
+			w.lock.Unlock()
+			if changed {
+				w.log.Infof("consul: trust bundle of peer %s changed", peer)
+				w.notifyChanged()
+			}
+
+			if startup && first {
+				w.ready.Done()
+			}
+
+			first = false
+			time.Sleep(peeringPollInterval)
+		}
+	}()
+}
+
+// setPeeredNodes decodes the instances of a peered upstream and the identity
+// they were exported with
+func (w *Watcher) setPeeredNodes(u *upstream, raw json.RawMessage, changed bool) error {
+	if !changed {
+		return nil
+	}
+
+	var nodes []*api.ServiceEntry
+	err := json.Unmarshal(raw, &nodes)
+	if err != nil {
+		return err
+	}
+	var entries []peeredServiceEntry
+	err = json.Unmarshal(raw, &entries)
+	if err != nil {
+		return err
+	}
+
+	sni, spiffeID := "", ""
+	for _, e := range entries {
+		m := e.Service.Connect.PeerMeta
+		if m != nil && len(m.SNI) > 0 && len(m.SpiffeID) > 0 {
+			sni, spiffeID = m.SNI[0], m.SpiffeID[0]
+			break
+		}
+	}
+	if len(nodes) > 0 && sni == "" {
+		return fmt.Errorf("no peer identity in the service instances")
+	}
+
+	w.lock.Lock()
+	u.Nodes = nodes
+	if sni != "" {
+		u.PeerSNI = sni
+		u.PeerSpiffeID = spiffeID
+	}
+	w.lock.Unlock()
+	w.notifyChanged()
+
+	return nil
+}
@@ -0,0 +1,37 @@
+package consul
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetPeeredNodes(t *testing.T) {
+	w := New("client-inst", nil, NewTestingLogger(t))
+	u := &upstream{Name: "service_db_peer_other", Peer: "other"}
+
+	raw := json.RawMessage(`[{
+		"Node": {"Node": "node1", "Address": "10.0.0.1"},
+		"Service": {
+			"Service": "db",
+			"Port": 8443,
+			"Connect": {
+				"PeerMeta": {
+					"SNI": ["db.default.default.other.external.peer.consul"],
+					"SpiffeID": ["spiffe://peer.consul/ns/default/dc/dc2/svc/db"]
+				}
+			}
+		}
+	}]`)
+	require.NoError(t, w.setPeeredNodes(u, raw, true))
+	require.Len(t, u.Nodes, 1)
+	require.Equal(t, 8443, u.Nodes[0].Service.Port)
+	require.Equal(t, "db.default.default.other.external.peer.consul", u.PeerSNI)
+	require.Equal(t, "spiffe://peer.consul/ns/default/dc/dc2/svc/db", u.PeerSpiffeID)
+
+	// instances without an identity are rejected
+	err := w.setPeeredNodes(u, json.RawMessage(`[{"Service": {"Service": "db", "Port": 8443}}]`), true)
+	require.Error(t, err)
+	require.Len(t, u.Nodes, 1)
+}
@@ -0,0 +1,320 @@
+package consul
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	consullib "github.com/hashicorp/consul/lib"
+)
+
+const (
+	// RTTModeWeight scales the weight of the instances of an upstream down
+	// with their round trip time
+	RTTModeWeight = "weight"
+	// RTTModeNearest only sends traffic to the nearest instances of an
+	// upstream, the others being backups
+	RTTModeNearest = "nearest"
+
+	DefaultRTTNearest = 3
+
+	// rttWeightScale is the factor applied to the weight of the nearest
+	// instances, leaving room to lower the weight of the farther ones
+	rttWeightScale = 10
+	// rttMinimum avoids favoring too much instances on the local node,
+	// whose estimated round trip time is close to 0
+	rttMinimum = time.Millisecond
+	maxWeight  = 256
+
+	datacenterCoordinatesPollInterval = time.Minute
+)
+
+// rttConfig is the round trip time aware balancing of an upstream, from its
+// rtt_mode and rtt_nearest config. The zero value disables it.
+type rttConfig struct {
+	Mode    string
+	Nearest int
+}
+
+func parseRTTConfig(config map[string]interface{}) (rttConfig, error) {
+	c := rttConfig{}
+
+	switch m := config["rtt_mode"].(type) {
+	case nil:
+		return c, nil
+	case string:
+		c.Mode = m
+	default:
+		return c, fmt.Errorf("invalid rtt_mode %v", m)
+	}
+
+	switch c.Mode {
+	case RTTModeWeight:
+		return c, nil
+	case RTTModeNearest:
+	default:
+		return rttConfig{}, fmt.Errorf("unknown rtt_mode %s", c.Mode)
+	}
+
+	c.Nearest = DefaultRTTNearest
+	switch n := config["rtt_nearest"].(type) {
+	case nil:
+	case float64:
+		c.Nearest = int(n)
+	case int:
+		c.Nearest = n
+	case string:
+		i, err := strconv.Atoi(n)
+		if err != nil {
+			return rttConfig{}, fmt.Errorf("invalid rtt_nearest: %s", err)
+		}
+		c.Nearest = i
+	default:
+		return rttConfig{}, fmt.Errorf("invalid rtt_nearest %v", n)
+	}
+	if c.Nearest < 1 {
+		return rttConfig{}, fmt.Errorf("invalid rtt_nearest %d", c.Nearest)
+	}
+
+	return c, nil
+}
+
+func (w *Watcher) upstreamRTT(up *upstream) rttConfig {
+	c, err := parseRTTConfig(up.Config)
+	if err != nil {
+		w.log.Errorf("upstream %s: %s, ignoring round trip times", up.Name, err)
+	}
+	return c
+}
+
+// coordinatesWatch is the watch of the network coordinates, stopped once
+// done
+type coordinatesWatch struct {
+	done bool
+}
+
+// startCoordinates watches the network coordinates of the nodes of the
+// local datacenter, and polls the ones of the servers of all datacenters.
+// Round trip times are unknown until they are fetched. It must be called
+// with the lock held.
+func (w *Watcher) startCoordinates() {
+	if w.coordinates != nil {
+		return
+	}
+	c := &coordinatesWatch{}
+	w.coordinates = c
+
+	w.log.Infof("consul: watching network coordinates")
+
+	go func() {
+		index := uint64(0)
+		for {
+			if c.done {
+				return
+			}
+			entries, meta, err := w.consul.Coordinate().Nodes(&api.QueryOptions{
+				WaitTime:  10 * time.Minute,
+				WaitIndex: index,
+			})
+			if err != nil {
+				w.log.Errorf("consul: error fetching node coordinates: %s", err)
+				time.Sleep(errorWaitTime)
+				index = 0
+				continue
+			}
+
+			changed := index != meta.LastIndex
+			index = meta.LastIndex
+			if !changed {
+				continue
+			}
+
+			coords := map[string][]*api.CoordinateEntry{}
+			for _, e := range entries {
+				coords[e.Node] = append(coords[e.Node], e)
+			}
+
+			w.lock.Lock()
+			if c.done {
+				w.lock.Unlock()
+				return
+			}
+			w.nodeCoordinates = coords
+			w.lock.Unlock()
+			w.notifyChanged()
+		}
+	}()
+
+	go func() {
+		for {
+			if c.done {
+				return
+			}
+			dcs, err := w.consul.Coordinate().Datacenters()
+			if err != nil {
+				w.log.Errorf("consul: error fetching datacenter coordinates: %s", err)
+				time.Sleep(errorWaitTime)
+				continue
+			}
+
+			coords := map[string][]api.CoordinateEntry{}
+			for _, dc := range dcs {
+				coords[dc.Datacenter] = append(coords[dc.Datacenter], dc.Coordinates...)
+			}
+
+			w.lock.Lock()
+			if c.done {
+				w.lock.Unlock()
+				return
+			}
+			changed := !reflect.DeepEqual(w.datacenterCoordinates, coords)
+			w.datacenterCoordinates = coords
+			w.lock.Unlock()
+			if changed {
+				w.notifyChanged()
+			}
+
+			time.Sleep(datacenterCoordinatesPollInterval)
+		}
+	}()
+}
+
+// stopCoordinates stops watching the network coordinates once no upstream
+// needs them. It must be called with the lock held.
+func (w *Watcher) stopCoordinates() {
+	if w.coordinates == nil {
+		return
+	}
+
+	w.log.Infof("consul: no longer watching network coordinates")
+
+	w.coordinates.done = true
+	w.coordinates = nil
+	w.nodeCoordinates = nil
+	w.datacenterCoordinates = nil
+}
+
+// rtt estimates the round trip time from the local node to the node of s.
+// Instances in other datacenters are estimated with the round trip time
+// between the servers of both datacenters.
+func (w *Watcher) rtt(s *api.ServiceEntry) (time.Duration, bool) {
+	if s.Node == nil {
+		return 0, false
+	}
+
+	if s.Node.Datacenter == "" || s.Node.Datacenter == w.datacenter {
+		d := math.Inf(1)
+		for _, a := range w.nodeCoordinates[w.nodeName] {
+			for _, b := range w.nodeCoordinates[s.Node.Node] {
+				if a.Segment == b.Segment {
+					d = math.Min(d, consullib.ComputeDistance(a.Coord, b.Coord))
+				}
+			}
+		}
+		return rttDuration(d)
+	}
+
+	// average distance between the servers of the datacenters
+	sum, count := 0.0, 0
+	for _, a := range w.datacenterCoordinates[w.datacenter] {
+		for _, b := range w.datacenterCoordinates[s.Node.Datacenter] {
+			d := consullib.ComputeDistance(a.Coord, b.Coord)
+			if math.IsInf(d, 0) {
+				continue
+			}
+			sum += d
+			count++
+		}
+	}
+	if count == 0 {
+		return 0, false
+	}
+	return rttDuration(sum / float64(count))
+}
+
+func rttDuration(seconds float64) (time.Duration, bool) {
+	if math.IsInf(seconds, 0) {
+		return 0, false
+	}
+	d := time.Duration(seconds * float64(time.Second))
+	if d < rttMinimum {
+		d = rttMinimum
+	}
+	return d, true
+}
+
+// applyRTT changes nodes according to the round trip time to their
+// instances, entries. Instances with an unknown round trip time are
+// considered the farthest.
+func (w *Watcher) applyRTT(c rttConfig, nodes []UpstreamNode, entries []*api.ServiceEntry) {
+	if c.Mode == "" || len(nodes) == 0 {
+		return
+	}
+
+	rtts := make([]time.Duration, len(nodes))
+	known := make([]bool, len(nodes))
+	for i, e := range entries {
+		rtts[i], known[i] = w.rtt(e)
+	}
+	balanceRTT(c, nodes, rtts, known)
+}
+
+// balanceRTT changes nodes according to their round trip times, rtts,
+// when known
+func balanceRTT(c rttConfig, nodes []UpstreamNode, rtts []time.Duration, known []bool) {
+	nearest, farthest := time.Duration(math.MaxInt64), time.Duration(0)
+	for i := range rtts {
+		if !known[i] {
+			continue
+		}
+		if rtts[i] < nearest {
+			nearest = rtts[i]
+		}
+		if rtts[i] > farthest {
+			farthest = rtts[i]
+		}
+	}
+	if farthest == 0 {
+		return
+	}
+	for i := range rtts {
+		if !known[i] {
+			rtts[i] = farthest
+		}
+	}
+
+	switch c.Mode {
+	case RTTModeWeight:
+		for i := range nodes {
+			weight := int(math.Round(float64(nodes[i].Weight*rttWeightScale) * float64(nearest) / float64(rtts[i])))
+			if weight < 1 {
+				weight = 1
+			}
+			if weight > maxWeight {
+				weight = maxWeight
+			}
+			nodes[i].Weight = weight
+		}
+	case RTTModeNearest:
+		order := make([]int, len(nodes))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			if known[order[i]] != known[order[j]] {
+				return known[order[i]]
+			}
+			return rtts[order[i]] < rtts[order[j]]
+		})
+		if len(order) <= c.Nearest {
+			return
+		}
+		for _, i := range order[c.Nearest:] {
+			nodes[i].Backup = true
+		}
+	}
+}
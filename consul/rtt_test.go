@@ -0,0 +1,57 @@
+package consul
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRTTConfig(t *testing.T) {
+	c, err := parseRTTConfig(nil)
+	require.NoError(t, err)
+	require.Equal(t, rttConfig{}, c)
+
+	c, err = parseRTTConfig(map[string]interface{}{"rtt_mode": "weight"})
+	require.NoError(t, err)
+	require.Equal(t, rttConfig{Mode: RTTModeWeight}, c)
+
+	c, err = parseRTTConfig(map[string]interface{}{"rtt_mode": "nearest"})
+	require.NoError(t, err)
+	require.Equal(t, rttConfig{Mode: RTTModeNearest, Nearest: DefaultRTTNearest}, c)
+
+	c, err = parseRTTConfig(map[string]interface{}{"rtt_mode": "nearest", "rtt_nearest": float64(2)})
+	require.NoError(t, err)
+	require.Equal(t, rttConfig{Mode: RTTModeNearest, Nearest: 2}, c)
+
+	_, err = parseRTTConfig(map[string]interface{}{"rtt_mode": "fastest"})
+	require.Error(t, err)
+	_, err = parseRTTConfig(map[string]interface{}{"rtt_mode": "nearest", "rtt_nearest": float64(0)})
+	require.Error(t, err)
+}
+
+func TestBalanceRTT(t *testing.T) {
+	testNodes := func() []UpstreamNode {
+		return []UpstreamNode{
+			{Host: "1.1.1.1", Weight: 1},
+			{Host: "1.1.1.2", Weight: 1},
+			{Host: "1.1.1.3", Weight: 1},
+			{Host: "1.1.1.4", Weight: 1},
+		}
+	}
+	rtts := []time.Duration{2 * time.Millisecond, 20 * time.Millisecond, 5 * time.Millisecond, 0}
+	known := []bool{true, true, true, false}
+
+	nodes := testNodes()
+	balanceRTT(rttConfig{Mode: RTTModeWeight}, nodes, rtts, known)
+	require.Equal(t, []int{10, 1, 4, 1}, []int{nodes[0].Weight, nodes[1].Weight, nodes[2].Weight, nodes[3].Weight})
+
+	nodes = testNodes()
+	balanceRTT(rttConfig{Mode: RTTModeNearest, Nearest: 2}, nodes, rtts, known)
+	require.Equal(t, []bool{false, true, false, true}, []bool{nodes[0].Backup, nodes[1].Backup, nodes[2].Backup, nodes[3].Backup})
+
+	// nothing changes until round trip times are known
+	nodes = testNodes()
+	balanceRTT(rttConfig{Mode: RTTModeNearest, Nearest: 2}, nodes, rtts, []bool{false, false, false, false})
+	require.Equal(t, testNodes(), nodes)
+}
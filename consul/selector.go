@@ -0,0 +1,136 @@
+package consul
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-bexpr"
+)
+
+// instanceSelector restricts the instances of an upstream to the ones with
+// all Tags, the NodeMeta node metadata and matching the Filter expression,
+// from the tags, node_meta and filter upstream config
+type instanceSelector struct {
+	Tags     []string
+	NodeMeta map[string]string
+	Filter   string
+}
+
+func parseInstanceSelector(config map[string]interface{}) (instanceSelector, error) {
+	s := instanceSelector{}
+
+	switch tags := config["tags"].(type) {
+	case nil:
+	case string:
+		for _, t := range strings.Split(tags, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				s.Tags = append(s.Tags, t)
+			}
+		}
+	case []interface{}:
+		for _, t := range tags {
+			ts, ok := t.(string)
+			if !ok {
+				return s, fmt.Errorf("invalid tag %v", t)
+			}
+			s.Tags = append(s.Tags, ts)
+		}
+	default:
+		return s, fmt.Errorf("invalid tags %v", tags)
+	}
+
+	switch meta := config["node_meta"].(type) {
+	case nil:
+	case map[string]interface{}:
+		s.NodeMeta = map[string]string{}
+		for k, v := range meta {
+			vs, ok := v.(string)
+			if !ok {
+				return s, fmt.Errorf("invalid node_meta value %v for %s", v, k)
+			}
+			s.NodeMeta[k] = vs
+		}
+	default:
+		return s, fmt.Errorf("invalid node_meta %v", meta)
+	}
+
+	switch filter := config["filter"].(type) {
+	case nil:
+	case string:
+		if filter != "" {
+			_, err := bexpr.CreateEvaluatorForType(filter, nil, (*api.ServiceEntry)(nil))
+			if err != nil {
+				return s, fmt.Errorf("invalid filter %s: %s", filter, err)
+			}
+		}
+		s.Filter = filter
+	default:
+		return s, fmt.Errorf("invalid filter %v", filter)
+	}
+
+	return s, nil
+}
+
+// empty returns whether s selects all the instances
+func (s instanceSelector) empty() bool {
+	return len(s.Tags) == 0 && len(s.NodeMeta) == 0 && s.Filter == ""
+}
+
+// filter returns the filter expression selecting the instances with the
+// tags, matching the Filter and extra expressions. Node metadata is passed
+// separately to the queries.
+func (s instanceSelector) filter(extra string) string {
+	var exprs []string
+	for _, e := range []string{extra, s.Filter} {
+		if e != "" {
+			exprs = append(exprs, e)
+		}
+	}
+	for _, t := range s.Tags {
+		exprs = append(exprs, fmt.Sprintf("%q in Service.Tags", t))
+	}
+
+	if len(exprs) == 1 {
+		return exprs[0]
+	}
+	for i, e := range exprs {
+		exprs[i] = "(" + e + ")"
+	}
+	return strings.Join(exprs, " and ")
+}
+
+// apply returns the nodes selected, for the queries which cannot filter
+// them such as prepared queries
+func (s instanceSelector) apply(nodes []*api.ServiceEntry) ([]*api.ServiceEntry, error) {
+	var eval *bexpr.Evaluator
+	if expr := s.filter(""); expr != "" {
+		var err error
+		eval, err = bexpr.CreateEvaluatorForType(expr, nil, (*api.ServiceEntry)(nil))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res := make([]*api.ServiceEntry, 0, len(nodes))
+NODES:
+	for _, n := range nodes {
+		for k, v := range s.NodeMeta {
+			if n.Node == nil || n.Node.Meta[k] != v {
+				continue NODES
+			}
+		}
+		if eval != nil {
+			ok, err := eval.Evaluate(n)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		res = append(res, n)
+	}
+
+	return res, nil
+}
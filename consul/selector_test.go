@@ -0,0 +1,81 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseInstanceSelector(t *testing.T) {
+	s, err := parseInstanceSelector(map[string]interface{}{
+		"tags":      "v2, canary",
+		"node_meta": map[string]interface{}{"rack": "r1"},
+		"filter":    `Service.Meta.version == "2"`,
+	})
+	require.NoError(t, err)
+	require.Equal(t, instanceSelector{
+		Tags:     []string{"v2", "canary"},
+		NodeMeta: map[string]string{"rack": "r1"},
+		Filter:   `Service.Meta.version == "2"`,
+	}, s)
+
+	s, err = parseInstanceSelector(map[string]interface{}{
+		"tags": []interface{}{"v2"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"v2"}, s.Tags)
+
+	_, err = parseInstanceSelector(map[string]interface{}{
+		"node_meta": "rack",
+	})
+	require.Error(t, err)
+
+	_, err = parseInstanceSelector(map[string]interface{}{
+		"filter": "invalid ==",
+	})
+	require.Error(t, err)
+}
+
+func TestInstanceSelectorFilter(t *testing.T) {
+	require.Equal(t, "", instanceSelector{}.filter(""))
+	require.Equal(t, "Service.ID == a", instanceSelector{}.filter("Service.ID == a"))
+	require.Equal(t,
+		`(Service.ID == a) and (Service.Port == 80) and ("v2" in Service.Tags)`,
+		instanceSelector{
+			Tags:   []string{"v2"},
+			Filter: "Service.Port == 80",
+		}.filter("Service.ID == a"),
+	)
+}
+
+func TestInstanceSelectorApply(t *testing.T) {
+	nodes := []*api.ServiceEntry{
+		{
+			Node:    &api.Node{Node: "n1", Meta: map[string]string{"rack": "r1"}},
+			Service: &api.AgentService{ID: "a", Tags: []string{"v2"}},
+		},
+		{
+			Node:    &api.Node{Node: "n2", Meta: map[string]string{"rack": "r2"}},
+			Service: &api.AgentService{ID: "b", Tags: []string{"v2"}},
+		},
+		{
+			Node:    &api.Node{Node: "n3", Meta: map[string]string{"rack": "r1"}},
+			Service: &api.AgentService{ID: "c", Tags: []string{"v1"}},
+		},
+	}
+
+	res, err := instanceSelector{}.apply(nodes)
+	require.NoError(t, err)
+	require.Equal(t, nodes, res)
+
+	res, err = instanceSelector{
+		Tags:     []string{"v2"},
+		NodeMeta: map[string]string{"rack": "r1"},
+	}.apply(nodes)
+	require.NoError(t, err)
+	require.Equal(t, []*api.ServiceEntry{nodes[0]}, res)
+
+	_, err = instanceSelector{Filter: "invalid =="}.apply(nodes)
+	require.Error(t, err)
+}
@@ -0,0 +1,69 @@
+package consul
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+)
+
+// DefaultNamespace and DefaultPartition are used when consul does not
+// report any, as consul OSS does
+const (
+	DefaultNamespace = "default"
+	DefaultPartition = "default"
+)
+
+var spiffeIDServiceRegexp = regexp.MustCompile(`^(?:/ap/([^/]+))?/ns/([^/]+)/dc/([^/]+)/svc/([^/]+)$`)
+
+// SpiffeID identifies a service of the mesh. Unlike connect.SpiffeIDService
+// it knows about the admin partitions, which are part of the URI when not
+// the default one.
+type SpiffeID struct {
+	Host       string
+	Partition  string
+	Namespace  string
+	Datacenter string
+	Service    string
+}
+
+// ParseSpiffeID parses the URI SAN of a service certificate
+func ParseSpiffeID(u *url.URL) (*SpiffeID, error) {
+	if u.Scheme != "spiffe" {
+		return nil, fmt.Errorf("%s is not a spiffe ID", u)
+	}
+
+	m := spiffeIDServiceRegexp.FindStringSubmatch(u.Path)
+	if m == nil {
+		return nil, fmt.Errorf("%s is not a service identity", u)
+	}
+
+	id := &SpiffeID{
+		Host:       u.Host,
+		Partition:  m[1],
+		Namespace:  m[2],
+		Datacenter: m[3],
+		Service:    m[4],
+	}
+	if id.Partition == "" {
+		id.Partition = DefaultPartition
+	}
+
+	return id, nil
+}
+
+// URI returns the URI SAN of the certificates of the service
+func (id *SpiffeID) URI() *url.URL {
+	path := fmt.Sprintf("/ns/%s/dc/%s/svc/%s", id.Namespace, id.Datacenter, id.Service)
+	if id.Partition != "" && id.Partition != DefaultPartition {
+		path = fmt.Sprintf("/ap/%s%s", id.Partition, path)
+	}
+	return &url.URL{
+		Scheme: "spiffe",
+		Host:   id.Host,
+		Path:   path,
+	}
+}
+
+func (id *SpiffeID) String() string {
+	return id.URI().String()
+}
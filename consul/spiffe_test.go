@@ -0,0 +1,36 @@
+package consul
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpiffeID(t *testing.T) {
+	for _, tc := range []struct {
+		uri      string
+		expected SpiffeID
+	}{
+		{
+			uri:      "spiffe://11111111-2222-3333-4444-555555555555.consul/ns/default/dc/dc1/svc/web",
+			expected: SpiffeID{Host: "11111111-2222-3333-4444-555555555555.consul", Partition: "default", Namespace: "default", Datacenter: "dc1", Service: "web"},
+		},
+		{
+			uri:      "spiffe://11111111-2222-3333-4444-555555555555.consul/ap/team/ns/backend/dc/dc1/svc/db",
+			expected: SpiffeID{Host: "11111111-2222-3333-4444-555555555555.consul", Partition: "team", Namespace: "backend", Datacenter: "dc1", Service: "db"},
+		},
+	} {
+		u, err := url.Parse(tc.uri)
+		require.NoError(t, err)
+		id, err := ParseSpiffeID(u)
+		require.NoError(t, err)
+		require.Equal(t, tc.expected, *id)
+		require.Equal(t, tc.uri, id.String())
+	}
+
+	u, err := url.Parse("spiffe://11111111-2222-3333-4444-555555555555.consul/agent/client/dc/dc1/id/node")
+	require.NoError(t, err)
+	_, err = ParseSpiffeID(u)
+	require.Error(t, err)
+}
@@ -0,0 +1,227 @@
+package consul
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/consul/agent/connect"
+	"github.com/hashicorp/consul/api"
+)
+
+// terminatingGatewayConfigEntry decodes the services linked to a gateway by
+// its terminating-gateway config entry, with their external TLS settings
+type terminatingGatewayConfigEntry struct {
+	Kind     string
+	Name     string
+	Services []linkedService
+}
+
+type linkedService struct {
+	Name      string
+	Namespace string
+	CAFile    string
+	CertFile  string
+	KeyFile   string
+	SNI       string
+}
+
+type terminatingService struct {
+	Linked      linkedService
+	ExternalTLS *ExternalTLS
+	Leaf        *certLeaf
+	Intentions  *serviceIntentions
+	Nodes       []*api.ServiceEntry
+
+	done bool
+}
+
+// handleTerminatingGateway starts watching the services linked to the
+// gateway by the terminating-gateway config entry, and stops the ones not
+// linked anymore. It must be called with the lock held.
+func (w *Watcher) handleTerminatingGateway(first bool, entry json.RawMessage) {
+	linked := map[string]linkedService{}
+	if entry != nil {
+		e := &terminatingGatewayConfigEntry{}
+		err := json.Unmarshal(entry, e)
+		if err != nil {
+			w.log.Errorf("consul: error decoding %s config entry %s: %s", GatewayTerminating, w.serviceName, err)
+			return
+		}
+		for _, s := range e.Services {
+			if s.Name == "*" {
+				w.log.Errorf("consul: %s %s: wildcard services are not supported", GatewayTerminating, w.serviceName)
+				continue
+			}
+			linked[w.linkedNamespace(s)+"/"+s.Name] = s
+		}
+	}
+
+	// services are keyed by namespace and name, as services with the same
+	// name can be linked from different namespaces
+	for key, s := range w.terminating {
+		l, ok := linked[key]
+		if ok && reflect.DeepEqual(l, s.Linked) {
+			continue
+		}
+		w.log.Infof("consul: removing terminated service %s", key)
+		s.done = true
+		s.Leaf.done = true
+		s.Intentions.done = true
+		delete(w.terminating, key)
+	}
+
+	for key, l := range linked {
+		if _, ok := w.terminating[key]; ok {
+			continue
+		}
+
+		var tls *ExternalTLS
+		if l.CAFile != "" || l.CertFile != "" || l.SNI != "" {
+			var err error
+			tls, err = readExternalTLS(l)
+			if err != nil {
+				w.log.Errorf("consul: terminated service %s: %s", key, err)
+				continue
+			}
+		}
+
+		s := &terminatingService{
+			Linked:      l,
+			ExternalTLS: tls,
+			Leaf:        &certLeaf{},
+			Intentions:  &serviceIntentions{},
+		}
+		w.terminating[key] = s
+		w.startTerminatingService(first, s)
+	}
+}
+
+// linkedNamespace returns the namespace of a linked service, which defaults
+// to the one of the gateway
+func (w *Watcher) linkedNamespace(l linkedService) string {
+	if l.Namespace != "" {
+		return l.Namespace
+	}
+	if w.namespace != "" {
+		return w.namespace
+	}
+	return DefaultNamespace
+}
+
+func readExternalTLS(l linkedService) (*ExternalTLS, error) {
+	tls := &ExternalTLS{
+		SNI: l.SNI,
+	}
+	if l.CAFile != "" {
+		ca, err := ioutil.ReadFile(l.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tls.CAs = [][]byte{ca}
+	}
+	if l.CertFile != "" {
+		cert, err := ioutil.ReadFile(l.CertFile)
+		if err != nil {
+			return nil, err
+		}
+		key, err := ioutil.ReadFile(l.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tls.Cert = cert
+		tls.Key = key
+	}
+	return tls, nil
+}
+
+func (w *Watcher) startTerminatingService(startup bool, s *terminatingService) {
+	name := s.Linked.Name
+	w.log.Infof("consul: watching terminated service %s", name)
+
+	if startup {
+		w.ready.Add(2)
+	}
+
+	go w.watchServiceLeaf(startup, name, s.Linked.Namespace, s.Leaf)
+	if w.http != nil {
+		if startup {
+			w.ready.Add(1)
+		}
+		go w.watchServiceIntentions(startup, name, s.Linked.Namespace, s.Intentions)
+	}
+
+	go func() {
+		index := uint64(0)
+		first := true
+		for {
+			if s.done {
+				return
+			}
+			nodes, meta, err := w.consul.Health().Service(name, "", false, &api.QueryOptions{
+				Namespace: s.Linked.Namespace,
+				WaitTime:  10 * time.Minute,
+				WaitIndex: index,
+			})
+			if err != nil {
+				w.log.Errorf("consul: error fetching service definition for terminated service %s: %s", name, err)
+				time.Sleep(errorWaitTime)
+				index = 0
+				continue
+			}
+			changed := index != meta.LastIndex
+			index = meta.LastIndex
+
+			if changed {
+				w.lock.Lock()
+				s.Nodes = nodes
+				w.lock.Unlock()
+				w.notifyChanged()
+			}
+
+			if startup && first {
+				w.ready.Done()
+			}
+
+			first = false
+		}
+	}()
+}
+
+func (w *Watcher) genTerminatingServices(alive, total *int) []TerminatingService {
+	var res []TerminatingService
+	for _, s := range w.terminating {
+		if len(s.Leaf.Cert) == 0 {
+			// not ready yet
+			continue
+		}
+
+		name := s.Linked.Name
+		ns := w.linkedNamespace(s.Linked)
+		res = append(res, TerminatingService{
+			Name:           name,
+			Namespace:      ns,
+			SNI:            connect.ServiceSNI(name, "", ns, w.datacenter, w.trustDomain),
+			ConnectTimeout: w.downstream.ConnectTimeout,
+			ReadTimeout:    w.downstream.ReadTimeout,
+			TLS: TLS{
+				CAs:  w.certCAs,
+				Cert: s.Leaf.Cert,
+				Key:  s.Leaf.Key,
+			},
+			ExternalTLS: s.ExternalTLS,
+			Nodes:       w.genUpstreamNodes(s.Nodes, nil, alive, total),
+		})
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Namespace != res[j].Namespace {
+			return res[i].Namespace < res[j].Namespace
+		}
+		return res[i].Name < res[j].Name
+	})
+
+	return res
+}
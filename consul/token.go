@@ -0,0 +1,145 @@
+package consul
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tokenHeader             = "X-Consul-Token"
+	aclNotFound             = "ACL not found"
+	tokenFileReloadInterval = 10 * time.Second
+)
+
+// TokenTransport sets the consul ACL token returned by Token on the requests
+// it forwards to Base. When set, Refresh is called with a token consul does
+// not know anymore and the request is retried if it returns true.
+type TokenTransport struct {
+	Base    http.RoundTripper
+	Token   func() string
+	Refresh func(rejected string) bool
+}
+
+func (t *TokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token := t.Token()
+	if token == "" {
+		return t.Base.RoundTrip(req)
+	}
+
+	// a RoundTripper must not modify the request
+	r := req.Clone(req.Context())
+	r.Header.Set(tokenHeader, token)
+	resp, err := t.Base.RoundTrip(r)
+	if err != nil || resp.StatusCode != http.StatusForbidden || t.Refresh == nil {
+		return resp, err
+	}
+	if req.Body != nil && req.GetBody == nil {
+		// the request cannot be replayed
+		return resp, nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if !strings.Contains(string(body), aclNotFound) || !t.Refresh(token) {
+		return resp, nil
+	}
+
+	r = req.Clone(req.Context())
+	if req.GetBody != nil {
+		r.Body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+	r.Header.Set(tokenHeader, t.Token())
+	return t.Base.RoundTrip(r)
+}
+
+// TokenFile holds an ACL token read from a file, reloaded when it changes so
+// rotated tokens are picked up
+type TokenFile struct {
+	path string
+	log  Logger
+
+	lock    sync.RWMutex
+	token   string
+	modTime time.Time
+}
+
+// NewTokenFile reads the token in path and watches it until stop is closed
+func NewTokenFile(path string, log Logger, stop <-chan struct{}) (*TokenFile, error) {
+	f := &TokenFile{
+		path: path,
+		log:  log,
+	}
+
+	_, err := f.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		ticker := time.NewTicker(tokenFileReloadInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				reloaded, err := f.reload()
+				if err != nil {
+					f.log.Errorf("consul: error reloading token file %s, keeping the previous token: %s", path, err)
+					continue
+				}
+				if reloaded {
+					f.log.Infof("consul: reloaded token file %s", path)
+				}
+			}
+		}
+	}()
+
+	return f, nil
+}
+
+// reload reads the token file if it changed since the last load
+func (f *TokenFile) reload() (bool, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return false, err
+	}
+
+	f.lock.RLock()
+	unchanged := info.ModTime().Equal(f.modTime)
+	f.lock.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	b, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return false, err
+	}
+
+	f.lock.Lock()
+	f.token = strings.TrimSpace(string(b))
+	f.modTime = info.ModTime()
+	f.lock.Unlock()
+
+	return true, nil
+}
+
+// Token returns the last token read
+func (f *TokenFile) Token() string {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.token
+}
@@ -0,0 +1,94 @@
+package consul
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "token")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tokenPath := path.Join(dir, "token")
+	require.NoError(t, ioutil.WriteFile(tokenPath, []byte("first\n"), 0600))
+
+	stop := make(chan struct{})
+	defer close(stop)
+	f, err := NewTokenFile(tokenPath, NewTestingLogger(t), stop)
+	require.NoError(t, err)
+	require.Equal(t, "first", f.Token())
+
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(tokenHeader)
+	}))
+	defer srv.Close()
+	client := &http.Client{
+		Transport: &TokenTransport{
+			Base:  http.DefaultTransport,
+			Token: f.Token,
+		},
+	}
+
+	_, err = client.Get(srv.URL)
+	require.NoError(t, err)
+	require.Equal(t, "first", got)
+
+	require.NoError(t, ioutil.WriteFile(tokenPath, []byte("second"), 0600))
+	// make sure the modification time changes whatever the fs resolution
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(tokenPath, future, future))
+	reloaded, err := f.reload()
+	require.NoError(t, err)
+	require.True(t, reloaded)
+
+	_, err = client.Get(srv.URL)
+	require.NoError(t, err)
+	require.Equal(t, "second", got)
+}
+
+func TestTokenTransportRefresh(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(tokenHeader) != "new" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(aclNotFound))
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	token := "old"
+	refreshed := 0
+	client := &http.Client{
+		Transport: &TokenTransport{
+			Base:  http.DefaultTransport,
+			Token: func() string { return token },
+			Refresh: func(rejected string) bool {
+				require.Equal(t, "old", rejected)
+				refreshed++
+				token = "new"
+				return true
+			},
+		},
+	}
+
+	resp, err := client.Post(srv.URL, "text/plain", strings.NewReader("hello"))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(body))
+	require.Equal(t, 1, refreshed)
+}
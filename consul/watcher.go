@@ -5,12 +5,14 @@ import (
 	"fmt"
 	"reflect"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/hashicorp/consul/agent/connect"
 	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/consul/command/connect/proxy"
-	log "github.com/sirupsen/logrus"
 )
 
 const (
@@ -21,17 +23,72 @@ const (
 
 	errorWaitTime             = 5 * time.Second
 	preparedQueryPollInterval = 30 * time.Second
+	// preparedQueryFailoverBackupTime is how long the instances of the
+	// datacenter a prepared query failed over to are kept as backups once
+	// local instances are back
+	preparedQueryFailoverBackupTime = 10 * time.Minute
+
+	DefaultMeshGatewayService = "mesh-gateway"
 )
 
 type upstream struct {
 	LocalBindAddress string
 	LocalBindPort    int
 	Name             string
+	Service          string
+	Namespace        string
 	Datacenter       string
 	Protocol         string
+	MeshGateway      api.MeshGatewayConfig
+	Config           map[string]interface{}
+	Selector         instanceSelector
+	Settings         upstreamSettings
 	Nodes            []*api.ServiceEntry
-	ReadTimeout      time.Duration
+
+	// BackupNodes are the instances of BackupDatacenter a prepared query
+	// failed over to, while the instances of ServingDatacenter are back
+	BackupNodes       []*api.ServiceEntry
+	BackupDatacenter  string
+	ServingDatacenter string
+
+	Chain   *api.CompiledDiscoveryChain
+	Routes  []UpstreamRoute
+	Targets map[string]*upstreamTarget
+
+	// Peer is the cluster peer the service is imported from, its instances
+	// are identified by PeerSNI and PeerSpiffeID and signed by PeerCAs
+	Peer         string
+	PeerCAs      [][]byte
+	PeerSNI      string
+	PeerSpiffeID string
+
+	done bool
+}
+
+// upstreamSettings are the settings of an upstream read from its config and
+// the config entries. They are parsed, and errors logged, when either
+// changes rather than each time the configuration is generated.
+type upstreamSettings struct {
 	ConnectTimeout   time.Duration
+	ReadTimeout      time.Duration
+	Locality         locality
+	RTT              rttConfig
+	AddressMode      string
+	WarningAsBackup  bool
+	OutlierDetection *OutlierDetection
+	Limits           *UpstreamLimits
+	// Balances are the load balancing of the services the upstream
+	// routes to, indexed by service name
+	Balances map[string]UpstreamBalance
+}
+
+type upstreamTarget struct {
+	ID     string
+	Target *api.DiscoveryTarget
+	// Gateway is the mesh gateway service the target is reached through,
+	// if any
+	Gateway string
+	Nodes   []*api.ServiceEntry
 
 	done bool
 }
@@ -39,13 +96,17 @@ type upstream struct {
 type downstream struct {
 	LocalBindAddress  string
 	LocalBindPort     int
-	Protocol          string
 	TargetAddress     string
 	TargetPort        int
 	EnableForwardFor  bool
 	AppNameHeaderName string
-	ReadTimeout       time.Duration
-	ConnectTimeout    time.Duration
+	AppNSHeaderName   string
+	MeshGateway       api.MeshGatewayConfig
+	Config            map[string]interface{}
+	// ConnectTimeout and ReadTimeout are parsed from Config and the
+	// proxy-defaults by updateDownstreamSettings
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
 }
 
 type certLeaf struct {
@@ -58,18 +119,56 @@ type certLeaf struct {
 type Watcher struct {
 	service     string
 	serviceName string
+	gateway     string
+	datacenter  string
 	consul      *api.Client
+	http        *HTTPClient
 	token       string
 	C           chan Config
 
+	// namespace and partition of the proxied service, empty when consul
+	// does not support them
+	namespace string
+	partition string
+	// nodeName and nodeMeta are the name and metadata of the local agent
+	nodeName string
+	nodeMeta map[string]string
+
+	// nodeCoordinates of the local datacenter and the coordinates of the
+	// servers of each datacenter, watched while an upstream needs them
+	nodeCoordinates       map[string][]*api.CoordinateEntry
+	datacenterCoordinates map[string][]api.CoordinateEntry
+	coordinates           *coordinatesWatch
+
 	lock  sync.Mutex
 	ready sync.WaitGroup
 
 	upstreams  map[string]*upstream
 	downstream downstream
-	certCAs    [][]byte
-	certCAPool *x509.CertPool
-	leaf       *certLeaf
+
+	certCAs     [][]byte
+	certCAPool  *x509.CertPool
+	trustDomain string
+	leaf        *certLeaf
+
+	serviceDefaults map[string]*api.ServiceConfigEntry
+	proxyDefaults   *api.ProxyConfigEntry
+	// serviceResolvers are the load balancers of the service-resolvers
+	serviceResolvers map[string]*loadBalancer
+
+	ingress         *ingressGatewayConfigEntry
+	terminating     map[string]*terminatingService
+	meshNamespaces  map[string]*meshNamespace
+	meshDatacenters map[string]*meshEndpoint
+
+	// intentions are all the intentions, or the ones matching the proxied
+	// service in serviceIntentions when watched with the match endpoint
+	intentions             []*intention
+	serviceIntentions      *serviceIntentions
+	intentionsDefaultAllow bool
+	// intentionsOnly is set when only watching intentions for a
+	// standalone SPOE agent
+	intentionsOnly bool
 
 	update chan struct{}
 	log    Logger
@@ -81,14 +180,49 @@ func New(service string, consul *api.Client, log Logger) *Watcher {
 		service: service,
 		consul:  consul,
 
-		C:         make(chan Config),
-		upstreams: make(map[string]*upstream),
-		update:    make(chan struct{}, 1),
-		log:       log,
+		C:                 make(chan Config),
+		upstreams:         make(map[string]*upstream),
+		serviceDefaults:   make(map[string]*api.ServiceConfigEntry),
+		terminating:       make(map[string]*terminatingService),
+		meshNamespaces:    make(map[string]*meshNamespace),
+		meshDatacenters:   make(map[string]*meshEndpoint),
+		serviceIntentions: &serviceIntentions{},
+		update:            make(chan struct{}, 1),
+		log:               log,
 	}
 }
 
+// NewGateway builds a new watcher for a gateway of the given kind
+func NewGateway(kind, service string, consul *api.Client, log Logger) *Watcher {
+	w := New(service, consul, log)
+	w.gateway = kind
+	return w
+}
+
 func (w *Watcher) Run() error {
+	var err error
+	switch {
+	case w.intentionsOnly:
+		err = w.startIntentions()
+	case w.gateway == "":
+		err = w.startSidecar()
+	default:
+		err = w.startGateway()
+	}
+	if err != nil {
+		return err
+	}
+
+	w.ready.Wait()
+
+	for range w.update {
+		w.C <- w.genCfg()
+	}
+
+	return nil
+}
+
+func (w *Watcher) startSidecar() error {
 	proxyID, err := proxy.LookupProxyIDForSidecar(w.consul, w.service)
 	if err != nil {
 		return err
@@ -100,39 +234,84 @@ func (w *Watcher) Run() error {
 	}
 
 	w.serviceName = svc.Service
+	w.namespace = svc.Namespace
 
-	w.ready.Add(4)
+	err = w.loadAgentConfig()
+	if err != nil {
+		return err
+	}
+
+	w.ready.Add(8)
 
 	go w.watchCA()
 	go w.watchLeaf()
+	go w.watchConfigEntries(api.ServiceDefaults, w.handleServiceDefaults)
+	go w.watchConfigEntries(api.ProxyDefaults, w.handleProxyDefaults)
+	go w.watchServiceResolvers()
 	go w.watchService(proxyID, w.handleProxyChange)
-	go w.watchService(w.service, func(first bool, srv *api.AgentService) {
+	go w.watchIntentions()
+	go w.watchService(w.service, func(first bool, srv *api.AgentService) error {
 		w.downstream.TargetPort = srv.Port
 		if first {
 			w.ready.Done()
 		}
+		return nil
 	})
 
-	w.ready.Wait()
+	return nil
+}
 
-	for range w.update {
-		w.C <- w.genCfg()
+// loadAgentConfig reads the datacenter of the agent, and its ACL default
+// policy which applies when no intention matches
+func (w *Watcher) loadAgentConfig() error {
+	self, err := w.consul.Agent().Self()
+	if err != nil {
+		return err
+	}
+	dc, ok := self["Config"]["Datacenter"].(string)
+	if !ok {
+		return fmt.Errorf("unable to find the agent datacenter")
+	}
+	w.datacenter = dc
+	w.partition, _ = self["Config"]["Partition"].(string)
+	w.nodeName, _ = self["Config"]["NodeName"].(string)
+	w.nodeMeta = map[string]string{}
+	for k, v := range self["Meta"] {
+		if s, ok := v.(string); ok {
+			w.nodeMeta[k] = s
+		}
+	}
+
+	w.intentionsDefaultAllow = true
+	if enabled, _ := self["DebugConfig"]["ACLsEnabled"].(bool); enabled {
+		policy, _ := self["DebugConfig"]["ACLDefaultPolicy"].(string)
+		w.intentionsDefaultAllow = policy != "deny"
 	}
 
 	return nil
 }
 
-func (w *Watcher) handleProxyChange(first bool, srv *api.AgentService) {
+// handleProxyChange updates the downstream and upstreams of the proxy. When
+// the peers of the upstreams cannot be fetched, the upstreams are kept
+// unchanged and an error is returned for the change to be handled again.
+func (w *Watcher) handleProxyChange(first bool, srv *api.AgentService) error {
+	peers, err := w.upstreamPeers(srv.ID)
+	if err != nil {
+		return err
+	}
+
 	w.downstream.LocalBindAddress = DefaultDownstreamBindAddr
 	w.downstream.LocalBindPort = srv.Port
 	w.downstream.TargetAddress = DefaultUpstreamBindAddr
-	w.downstream.ReadTimeout = DefaultReadTimeout
-	w.downstream.ConnectTimeout = DefaultConnectTimeout
+	w.downstream.MeshGateway = api.MeshGatewayConfig{}
+	w.downstream.Config = nil
+
+	if srv.Proxy != nil {
+		w.downstream.MeshGateway = srv.Proxy.MeshGateway
+	}
 
 	if srv.Proxy != nil && srv.Proxy.Config != nil {
-		if c, ok := srv.Proxy.Config["protocol"].(string); ok {
-			w.downstream.Protocol = c
-		}
+		w.downstream.Config = srv.Proxy.Config
 		if b, ok := srv.Proxy.Config["bind_address"].(string); ok {
 			w.downstream.LocalBindAddress = b
 		}
@@ -145,42 +324,58 @@ func (w *Watcher) handleProxyChange(first bool, srv *api.AgentService) {
 		if a, ok := srv.Proxy.Config["appname_header"].(string); ok {
 			w.downstream.AppNameHeaderName = a
 		}
-		if a, ok := srv.Proxy.Config["connect_timeout"].(string); ok {
-			to, err := time.ParseDuration(a)
-			if err != nil {
-				log.Errorf("bad connect_timeout value in config: %s. Using default: %s", err, DefaultConnectTimeout)
-			} else {
-				w.downstream.ConnectTimeout = to
-			}
-		}
-		if a, ok := srv.Proxy.Config["read_timeout"].(string); ok {
-			to, err := time.ParseDuration(a)
-			if err != nil {
-				log.Errorf("bad read_timeout value in config: %s. Using default: %s", err, DefaultReadTimeout)
-			} else {
-				w.downstream.ReadTimeout = to
-			}
+		if a, ok := srv.Proxy.Config["appnamespace_header"].(string); ok {
+			w.downstream.AppNSHeaderName = a
 		}
 	}
 
+	w.lock.Lock()
+	w.updateDownstreamSettings()
+	w.lock.Unlock()
+
 	keep := make(map[string]bool)
+	rtt := false
 
 	if srv.Proxy != nil {
-		for _, up := range srv.Proxy.Upstreams {
-			name := fmt.Sprintf("%s_%s", up.DestinationType, up.DestinationName)
+		names := upstreamNames(srv.Proxy.Upstreams, peers)
+		for i, up := range srv.Proxy.Upstreams {
+			peer := ""
+			if i < len(peers) {
+				peer = peers[i]
+			}
+			name := names[i]
+			if keep[name] {
+				w.log.Errorf("consul: ignoring duplicate upstream %s", name)
+				continue
+			}
+			selector, err := parseInstanceSelector(up.Config)
+			if err != nil {
+				w.log.Errorf("consul: upstream %s: %s", name, err)
+				continue
+			}
 			keep[name] = true
+			if _, ok := up.Config["rtt_mode"]; ok {
+				rtt = true
+			}
 			w.lock.Lock()
-			_, ok := w.upstreams[name]
+			u, ok := w.upstreams[name]
 			w.lock.Unlock()
+			if ok && !reflect.DeepEqual(u.Selector, selector) {
+				// running queries select the instances, restart them
+				w.removeUpstream(name)
+				ok = false
+			}
 			if !ok {
-				switch up.DestinationType {
-				case api.UpstreamDestTypePreparedQuery:
+				switch {
+				case up.DestinationType == api.UpstreamDestTypePreparedQuery:
 					w.startUpstreamPreparedQuery(first, up, name)
+				case peer != "":
+					w.startUpstreamPeered(first, up, peer, name)
 				default:
 					w.startUpstreamService(first, up, name)
 				}
 			} else {
-				w.updateUpstream(up, w.upstreams[name])
+				w.updateUpstream(up, u)
 			}
 		}
 	}
@@ -191,17 +386,127 @@ func (w *Watcher) handleProxyChange(first bool, srv *api.AgentService) {
 		}
 	}
 
+	w.lock.Lock()
+	if rtt {
+		w.startCoordinates()
+	} else {
+		w.stopCoordinates()
+	}
+	w.lock.Unlock()
+
 	if first {
 		w.ready.Done()
 	}
+	return nil
+}
+
+// upstreamNames names the upstreams of a proxy, peers being the cluster
+// peers they are imported from. Upstreams keep their legacy name, from their
+// destination, unless several of them share it or it is the qualified name
+// of another one.
+func upstreamNames(ups []api.Upstream, peers []string) []string {
+	legacy := make([]string, len(ups))
+	qualified := make([]string, len(ups))
+	count := map[string]int{}
+	for i, up := range ups {
+		peer := ""
+		if i < len(peers) {
+			peer = peers[i]
+		}
+		legacy[i] = legacyUpstreamName(up, peer)
+		qualified[i] = upstreamName(up, peer)
+		count[legacy[i]]++
+	}
+
+	taken := map[string]bool{}
+	for i := range ups {
+		if count[legacy[i]] > 1 {
+			taken[qualified[i]] = true
+		}
+	}
+
+	names := make([]string, len(ups))
+	for i := range ups {
+		if count[legacy[i]] == 1 && !taken[legacy[i]] {
+			names[i] = legacy[i]
+		} else {
+			names[i] = qualified[i]
+		}
+	}
+	return names
+}
+
+// legacyUpstreamName names an upstream after its destination, namespace and
+// peer, unescaped, as done before upstreams were told apart by datacenter and
+// bind address
+func legacyUpstreamName(up api.Upstream, peer string) string {
+	name := fmt.Sprintf("%s_%s", up.DestinationType, up.DestinationName)
+	if up.DestinationNamespace != "" && up.DestinationNamespace != DefaultNamespace {
+		name = fmt.Sprintf("%s_%s_%s", up.DestinationType, up.DestinationNamespace, up.DestinationName)
+	}
+	if peer != "" {
+		name = fmt.Sprintf("%s_peer_%s", name, peer)
+	}
+	return name
+}
+
+// upstreamName identifies an upstream by its destination, datacenter,
+// namespace, peer and bind address. It is used to name the HAProxy objects
+// of the upstream, its parts are escaped to only keep the characters HAProxy
+// allows.
+func upstreamName(up api.Upstream, peer string) string {
+	parts := []string{string(up.DestinationType), escapeName(up.DestinationName)}
+	if up.DestinationNamespace != "" && up.DestinationNamespace != DefaultNamespace {
+		parts = append(parts, "ns", escapeName(up.DestinationNamespace))
+	}
+	if up.Datacenter != "" {
+		parts = append(parts, "dc", escapeName(up.Datacenter))
+	}
+	if peer != "" {
+		parts = append(parts, "peer", escapeName(peer))
+	}
+	if up.LocalBindAddress != "" && up.LocalBindAddress != DefaultUpstreamBindAddr {
+		parts = append(parts, escapeName(up.LocalBindAddress))
+	}
+	parts = append(parts, strconv.Itoa(up.LocalBindPort))
+
+	return strings.Join(parts, "_")
+}
+
+// escapeName escapes the characters HAProxy does not allow in names, and the
+// underscores separating the parts of upstream names, as a colon followed by
+// their hexadecimal value, so names cannot collide
+func escapeName(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '.':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, ":%02x", c)
+		}
+	}
+	return b.String()
 }
 
 func (w *Watcher) updateUpstream(up api.Upstream, u *upstream) {
 	u.LocalBindAddress = up.LocalBindAddress
 	u.LocalBindPort = up.LocalBindPort
 	u.Datacenter = up.Datacenter
-	u.ReadTimeout = DefaultReadTimeout
-	u.ConnectTimeout = DefaultConnectTimeout
+	u.Config = up.Config
+	// validated by handleProxyChange
+	u.Selector, _ = parseInstanceSelector(up.Config)
+	u.Protocol = ""
+	u.MeshGateway = up.MeshGateway
+	if u.MeshGateway.Mode == api.MeshGatewayModeDefault {
+		u.MeshGateway = w.downstream.MeshGateway
+	}
+
+	if up.DestinationType != api.UpstreamDestTypePreparedQuery {
+		u.Service = up.DestinationName
+		u.Namespace = up.DestinationNamespace
+	}
 
 	if u.LocalBindAddress == "" {
 		u.LocalBindAddress = "127.0.0.1"
@@ -211,23 +516,63 @@ func (w *Watcher) updateUpstream(up api.Upstream, u *upstream) {
 		u.Protocol = p
 	}
 
-	if a, ok := up.Config["read_timeout"].(string); ok {
-		to, err := time.ParseDuration(a)
-		if err != nil {
-			log.Errorf("upstream %s: bad read_timeout value in config: %s. Using default: %s", u.Name, err, DefaultReadTimeout)
-		} else {
-			u.ReadTimeout = to
-		}
+	w.lock.Lock()
+	w.updateUpstreamSettings(u)
+	w.lock.Unlock()
+}
+
+// updateSettings parses the settings of the downstream and all upstreams
+// again, after a change of the config entries. It must be called with the
+// lock held.
+func (w *Watcher) updateSettings() {
+	w.updateDownstreamSettings()
+	for _, u := range w.upstreams {
+		w.updateUpstreamSettings(u)
 	}
+}
 
-	if a, ok := up.Config["connect_timeout"].(string); ok {
-		to, err := time.ParseDuration(a)
-		if err != nil {
-			log.Errorf("upstream %s: bad connect_timeout value in config: %s. Using default: %s", u.Name, err, DefaultConnectTimeout)
-		} else {
-			u.ConnectTimeout = to
+// updateDownstreamSettings parses the timeouts of the downstream, it must be
+// called with the lock held
+func (w *Watcher) updateDownstreamSettings() {
+	owner := "downstream"
+	if w.gateway != "" {
+		owner = w.gateway + " gateway"
+	}
+	w.downstream.ConnectTimeout = w.timeout("connect_timeout", w.downstream.Config, DefaultConnectTimeout, owner)
+	w.downstream.ReadTimeout = w.timeout("read_timeout", w.downstream.Config, DefaultReadTimeout, owner)
+}
+
+// updateUpstreamSettings parses the settings of u, it must be called with
+// the lock held
+func (w *Watcher) updateUpstreamSettings(u *upstream) {
+	protocol := w.protocol(u.Config, u.Service)
+	owner := "upstream " + u.Name
+	u.Settings = upstreamSettings{
+		ConnectTimeout:   w.timeout("connect_timeout", u.Config, DefaultConnectTimeout, owner),
+		ReadTimeout:      w.timeout("read_timeout", u.Config, DefaultReadTimeout, owner),
+		Locality:         w.upstreamLocality(u),
+		RTT:              w.upstreamRTT(u),
+		AddressMode:      w.upstreamAddressMode(u),
+		WarningAsBackup:  w.warningAsBackup(u),
+		OutlierDetection: w.upstreamOutlierDetection(u, protocol),
+		Limits:           w.upstreamLimits(u),
+	}
+	w.updateUpstreamBalances(u)
+}
+
+// updateUpstreamBalances reads the load balancing of the services u routes
+// to, it must be called with the lock held
+func (w *Watcher) updateUpstreamBalances(u *upstream) {
+	protocol := w.protocol(u.Config, u.Service)
+	balances := map[string]UpstreamBalance{
+		u.Service: w.upstreamBalance(u, u.Service, protocol),
+	}
+	for _, t := range u.Targets {
+		if _, ok := balances[t.Target.Service]; !ok {
+			balances[t.Target.Service] = w.upstreamBalance(u, t.Target.Service, protocol)
 		}
 	}
+	u.Settings.Balances = balances
 }
 
 func (w *Watcher) startUpstreamService(startup bool, up api.Upstream, name string) {
@@ -238,7 +583,8 @@ func (w *Watcher) startUpstreamService(startup bool, up api.Upstream, name strin
 	}
 
 	u := &upstream{
-		Name: name,
+		Name:    name,
+		Targets: make(map[string]*upstreamTarget),
 	}
 
 	w.updateUpstream(up, u)
@@ -254,13 +600,151 @@ func (w *Watcher) startUpstreamService(startup bool, up api.Upstream, name strin
 			if u.done {
 				return
 			}
-			nodes, meta, err := w.consul.Health().Connect(up.DestinationName, "", true, &api.QueryOptions{
-				Datacenter: up.Datacenter,
+			w.lock.Lock()
+			opts := &api.DiscoveryChainOptions{
+				EvaluateInDatacenter: up.Datacenter,
+				OverrideProtocol:     u.Protocol,
+				OverrideMeshGateway:  u.MeshGateway,
+			}
+			w.lock.Unlock()
+			res, meta, err := w.consul.DiscoveryChain().Get(up.DestinationName, opts, &api.QueryOptions{
+				Namespace: up.DestinationNamespace,
+				WaitTime:  10 * time.Minute,
+				WaitIndex: index,
+			})
+			if err != nil {
+				w.log.Errorf("consul: error fetching discovery chain for service %s: %s", up.DestinationName, err)
+				time.Sleep(errorWaitTime)
+				index = 0
+				continue
+			}
+			changed := index != meta.LastIndex
+			index = meta.LastIndex
+
+			if changed {
+				w.updateUpstreamTargets(startup && first, u, res.Chain)
+				w.notifyChanged()
+			}
+
+			if startup && first {
+				w.ready.Done()
+			}
+
+			first = false
+		}
+	}()
+}
+
+func (w *Watcher) updateUpstreamTargets(startup bool, u *upstream, chain *api.CompiledDiscoveryChain) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	u.Chain = chain
+
+	targets := make(map[string]*api.DiscoveryTarget)
+	for _, id := range chainTargets(chain) {
+		if target, ok := chain.Targets[id]; ok {
+			targets[id] = target
+		}
+	}
+
+	w.setUpstreamTargets(startup, u, targets)
+}
+
+// setUpstreamTargets starts watching new targets and stops the ones not
+// in targets anymore, it must be called with the lock held
+func (w *Watcher) setUpstreamTargets(startup bool, u *upstream, targets map[string]*api.DiscoveryTarget) {
+	for id, target := range targets {
+		gateway := w.targetGateway(u, target)
+
+		t, ok := u.Targets[id]
+		if ok && reflect.DeepEqual(t.Target, target) && t.Gateway == gateway {
+			continue
+		}
+		if ok {
+			t.done = true
+		}
+
+		t = &upstreamTarget{
+			ID:      id,
+			Target:  target,
+			Gateway: gateway,
+		}
+		u.Targets[id] = t
+		w.startUpstreamTarget(startup, u, t)
+	}
+
+	for id, t := range u.Targets {
+		if _, ok := targets[id]; !ok {
+			t.done = true
+			delete(u.Targets, id)
+		}
+	}
+
+	w.updateUpstreamBalances(u)
+}
+
+// targetGateway returns the mesh gateway service to go through to reach
+// target, or an empty string to reach it directly. As in consul, gateways are
+// only used for targets in other datacenters.
+func (w *Watcher) targetGateway(u *upstream, target *api.DiscoveryTarget) string {
+	if target.Datacenter == "" || target.Datacenter == w.datacenter {
+		return ""
+	}
+
+	switch target.MeshGateway.Mode {
+	case api.MeshGatewayModeLocal, api.MeshGatewayModeRemote:
+	default:
+		return ""
+	}
+
+	if s, ok := u.Config["mesh_gateway_service"].(string); ok && s != "" {
+		return s
+	}
+	return DefaultMeshGatewayService
+}
+
+func (w *Watcher) startUpstreamTarget(startup bool, u *upstream, t *upstreamTarget) {
+	w.log.Infof("consul: watching target %s for upstream %s", t.ID, u.Name)
+	if t.Gateway != "" && !u.Selector.empty() {
+		w.log.Warnf("consul: upstream %s: target %s is reached through mesh gateway %s, ignoring its tags, node_meta and filter", u.Name, t.ID, t.Gateway)
+	}
+
+	if startup {
+		w.ready.Add(1)
+	}
+
+	go func() {
+		index := uint64(0)
+		first := true
+		for {
+			if t.done || u.done {
+				return
+			}
+			q := &api.QueryOptions{
+				Datacenter: t.Target.Datacenter,
 				WaitTime:   10 * time.Minute,
 				WaitIndex:  index,
-			})
+			}
+			var nodes []*api.ServiceEntry
+			var meta *api.QueryMeta
+			var err error
+			switch {
+			case t.Gateway == "":
+				q.Namespace = t.Target.Namespace
+				q.Filter = u.Selector.filter(t.Target.Subset.Filter)
+				q.NodeMeta = u.Selector.NodeMeta
+				// warning instances are used as well, with their weight
+				nodes, meta, err = w.consul.Health().Connect(t.Target.Service, "", false, q)
+			case t.Target.MeshGateway.Mode == api.MeshGatewayModeLocal:
+				q.Datacenter = ""
+				nodes, meta, err = w.consul.Health().Service(t.Gateway, "", true, q)
+			default:
+				nodes, meta, err = w.consul.Health().Service(t.Gateway, "", true, q)
+				nodes = wanServiceEntries(nodes)
+			}
 			if err != nil {
-				w.log.Errorf("consul: error fetching service definition for service %s: %s", up.DestinationName, err)
+				w.log.Errorf("consul: error fetching service definition for target %s: %s", t.ID, err)
 				time.Sleep(errorWaitTime)
 				index = 0
 				continue
@@ -270,7 +754,7 @@ func (w *Watcher) startUpstreamService(startup bool, up api.Upstream, name strin
 
 			if changed {
 				w.lock.Lock()
-				u.Nodes = nodes
+				t.Nodes = nodes
 				w.lock.Unlock()
 				w.notifyChanged()
 			}
@@ -318,34 +802,54 @@ func (w *Watcher) startUpstreamPreparedQuery(startup bool, up api.Upstream, name
 	w.lock.Unlock()
 
 	go func() {
-		var last []*api.ServiceEntry
+		var last, lastBackups []*api.ServiceEntry
+		// failoverDC is the last datacenter the query failed over to, its
+		// instances are kept as backups for a while once local ones are
+		// back, since recovered
+		failoverDC := ""
+		var recovered time.Time
 		first := true
 		for {
 			if u.done {
 				return
 			}
-			nodes, _, err := w.consul.PreparedQuery().Execute(up.DestinationName, &api.QueryOptions{
-				Connect:    true,
-				Datacenter: up.Datacenter,
-				WaitTime:   10 * time.Minute,
-			})
+			nodes, dc, failovers, err := w.executePreparedQuery(up, u, up.Datacenter)
 			if err != nil {
 				w.log.Errorf("consul: error fetching service definition for service %s: %s", up.DestinationName, err)
 				time.Sleep(errorWaitTime)
 				continue
 			}
 
-			nodesP := []*api.ServiceEntry{}
-			for i := range nodes.Nodes {
-				nodesP = append(nodesP, &nodes.Nodes[i])
+			var backups []*api.ServiceEntry
+			switch {
+			case failovers > 0:
+				failoverDC = dc
+				recovered = time.Time{}
+			case failoverDC == "":
+			case recovered.IsZero():
+				recovered = time.Now()
+			case time.Since(recovered) > preparedQueryFailoverBackupTime:
+				w.log.Infof("consul: upstream %s: no longer using the instances of datacenter %s as backups", u.Name, failoverDC)
+				failoverDC = ""
+			}
+			if failovers == 0 && failoverDC != "" && failoverDC != dc {
+				backups, _, _, err = w.executePreparedQuery(up, u, failoverDC)
+				if err != nil {
+					w.log.Errorf("consul: error fetching backups for service %s in datacenter %s: %s", up.DestinationName, failoverDC, err)
+					backups = lastBackups
+				}
 			}
 
-			if !reflect.DeepEqual(last, nodesP) {
+			if !reflect.DeepEqual(last, nodes) || !reflect.DeepEqual(lastBackups, backups) || u.ServingDatacenter != dc {
 				w.lock.Lock()
-				u.Nodes = nodesP
+				u.Nodes = nodes
+				u.BackupNodes = backups
+				u.BackupDatacenter = failoverDC
+				u.ServingDatacenter = dc
 				w.lock.Unlock()
 				w.notifyChanged()
-				last = nodesP
+				last = nodes
+				lastBackups = backups
 			}
 
 			if startup && first {
@@ -358,27 +862,69 @@ func (w *Watcher) startUpstreamPreparedQuery(startup bool, up api.Upstream, name
 	}()
 }
 
+// executePreparedQuery runs the prepared query of up in dc, and returns the
+// instances selected, the datacenter which answered and the number of
+// datacenters it failed over to
+func (w *Watcher) executePreparedQuery(up api.Upstream, u *upstream, dc string) ([]*api.ServiceEntry, string, int, error) {
+	res, _, err := w.consul.PreparedQuery().Execute(up.DestinationName, &api.QueryOptions{
+		Connect:    true,
+		Datacenter: dc,
+		WaitTime:   10 * time.Minute,
+	})
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	nodes := []*api.ServiceEntry{}
+	for i := range res.Nodes {
+		nodes = append(nodes, &res.Nodes[i])
+	}
+	nodes, err = u.Selector.apply(nodes)
+	if err != nil {
+		return nil, "", 0, fmt.Errorf("error selecting instances: %s", err)
+	}
+
+	return nodes, res.Datacenter, res.Failovers, nil
+}
+
 func (w *Watcher) removeUpstream(name string) {
 	w.log.Infof("consul: removing upstream for service %s", name)
 
 	w.lock.Lock()
 	w.upstreams[name].done = true
+	for _, t := range w.upstreams[name].Targets {
+		t.done = true
+	}
 	delete(w.upstreams, name)
 	w.lock.Unlock()
 }
 
 func (w *Watcher) watchLeaf() {
-	w.log.Debugf("consul: watching leaf cert for %s", w.serviceName)
+	w.lock.Lock()
+	w.leaf = &certLeaf{}
+	w.lock.Unlock()
+
+	w.watchServiceLeaf(true, w.serviceName, w.namespace, w.leaf)
+}
+
+// watchServiceLeaf keeps leaf up to date with the leaf cert of service in
+// namespace until leaf is done
+func (w *Watcher) watchServiceLeaf(startup bool, service, namespace string, leaf *certLeaf) {
+	w.log.Debugf("consul: watching leaf cert for %s", service)
 
 	var lastIndex uint64
 	first := true
 	for {
-		cert, meta, err := w.consul.Agent().ConnectCALeaf(w.serviceName, &api.QueryOptions{
+		if leaf.done {
+			return
+		}
+		cert, meta, err := w.consul.Agent().ConnectCALeaf(service, &api.QueryOptions{
+			Namespace: namespace,
 			WaitTime:  10 * time.Minute,
 			WaitIndex: lastIndex,
 		})
 		if err != nil {
-			w.log.Errorf("consul error fetching leaf cert for service %s: %s", w.serviceName, err)
+			w.log.Errorf("consul error fetching leaf cert for service %s: %s", service, err)
 			time.Sleep(errorWaitTime)
 			lastIndex = 0
 			continue
@@ -388,26 +934,25 @@ func (w *Watcher) watchLeaf() {
 		lastIndex = meta.LastIndex
 
 		if changed {
-			w.log.Infof("consul: leaf cert for service %s changed, serial: %s, valid before: %s, valid after: %s", w.serviceName, cert.SerialNumber, cert.ValidBefore, cert.ValidAfter)
+			w.log.Infof("consul: leaf cert for service %s changed, serial: %s, valid before: %s, valid after: %s", service, cert.SerialNumber, cert.ValidBefore, cert.ValidAfter)
 			w.lock.Lock()
-			if w.leaf == nil {
-				w.leaf = &certLeaf{}
-			}
-			w.leaf.Cert = []byte(cert.CertPEM)
-			w.leaf.Key = []byte(cert.PrivateKeyPEM)
+			leaf.Cert = []byte(cert.CertPEM)
+			leaf.Key = []byte(cert.PrivateKeyPEM)
 			w.lock.Unlock()
 			w.notifyChanged()
 		}
 
-		if first {
-			w.log.Infof("consul: leaf cert for %s ready", w.serviceName)
+		if startup && first {
+			w.log.Infof("consul: leaf cert for %s ready", service)
 			w.ready.Done()
-			first = false
 		}
+
+		first = false
 	}
 }
 
-func (w *Watcher) watchService(service string, handler func(first bool, srv *api.AgentService)) {
+// watchService calls handler on each change of service, until it succeeds
+func (w *Watcher) watchService(service string, handler func(first bool, srv *api.AgentService) error) {
 	w.log.Infof("consul: watching service %s", service)
 
 	hash := ""
@@ -429,7 +974,13 @@ func (w *Watcher) watchService(service string, handler func(first bool, srv *api
 
 		if changed {
 			w.log.Debugf("consul: service %s changed", service)
-			handler(first, srv)
+			err := handler(first, srv)
+			if err != nil {
+				w.log.Errorf("consul: error handling service %s change: %s", service, err)
+				time.Sleep(errorWaitTime)
+				hash = ""
+				continue
+			}
 			w.notifyChanged()
 		}
 
@@ -461,6 +1012,7 @@ func (w *Watcher) watchCA() {
 			w.log.Infof("consul: CA certs changed, active root id: %s", caList.ActiveRootID)
 			w.lock.Lock()
 			w.certCAs = w.certCAs[:0]
+			w.trustDomain = caList.TrustDomain
 			w.certCAPool = x509.NewCertPool()
 			for _, ca := range caList.Roots {
 				w.certCAs = append(w.certCAs, []byte(ca.RootCertPEM))
@@ -492,19 +1044,30 @@ func (w *Watcher) genCfg() Config {
 			serviceInstancesAlive, serviceInstancesTotal)
 	}()
 
+	if w.intentionsOnly {
+		return Config{
+			Intentions:             w.genIntentions(),
+			IntentionsDefaultAllow: w.intentionsDefaultAllow,
+		}
+	}
+
 	config := Config{
 		ServiceName: w.serviceName,
 		ServiceID:   w.service,
+		Namespace:   w.namespace,
+		Partition:   w.partition,
+		Gateway:     w.gateway,
 		Downstream: Downstream{
 			LocalBindAddress:  w.downstream.LocalBindAddress,
 			LocalBindPort:     w.downstream.LocalBindPort,
 			TargetAddress:     w.downstream.TargetAddress,
 			TargetPort:        w.downstream.TargetPort,
-			Protocol:          w.downstream.Protocol,
+			Protocol:          w.protocol(w.downstream.Config, w.serviceName),
 			ConnectTimeout:    w.downstream.ConnectTimeout,
 			ReadTimeout:       w.downstream.ReadTimeout,
 			EnableForwardFor:  w.downstream.EnableForwardFor,
 			AppNameHeaderName: w.downstream.AppNameHeaderName,
+			AppNSHeaderName:   w.downstream.AppNSHeaderName,
 
 			TLS: TLS{
 				CAs:  w.certCAs,
@@ -519,41 +1082,60 @@ func (w *Watcher) genCfg() Config {
 			Name:             up.Name,
 			LocalBindAddress: up.LocalBindAddress,
 			LocalBindPort:    up.LocalBindPort,
-			Protocol:         up.Protocol,
-			ConnectTimeout:   up.ConnectTimeout,
-			ReadTimeout:      up.ReadTimeout,
+			Protocol:         w.protocol(up.Config, up.Service),
+			Balance:          up.Settings.Balances[up.Service],
+			OutlierDetection: up.Settings.OutlierDetection,
+			Limits:           up.Settings.Limits,
+			ConnectTimeout:   up.Settings.ConnectTimeout,
+			ReadTimeout:      up.Settings.ReadTimeout,
 			TLS: TLS{
 				CAs:  w.certCAs,
 				Cert: w.leaf.Cert,
 				Key:  w.leaf.Key,
 			},
 		}
-		for _, s := range up.Nodes {
-			serviceInstancesTotal++
-			host := s.Service.Address
-			if host == "" {
-				host = s.Node.Address
-			}
 
-			weight := 1
-			switch s.Checks.AggregatedStatus() {
-			case api.HealthPassing:
-				weight = s.Service.Weights.Passing
-			case api.HealthWarning:
-				weight = s.Service.Weights.Warning
-			default:
-				continue
+		if up.Peer != "" {
+			upstream.TLS.CAs = append(append([][]byte{}, w.certCAs...), up.PeerCAs...)
+			upstream.SNI = up.PeerSNI
+			upstream.SpiffeID = up.PeerSpiffeID
+		}
+
+		switch {
+		case up.Routes != nil:
+			upstream.Routes = up.Routes
+			upstream.Targets = w.genUpstreamTargets(up, routesTargets(up.Routes), nil, nil, &serviceInstancesAlive, &serviceInstancesTotal)
+		case up.Chain == nil:
+			upstream.Nodes = w.genUpstreamNodes(up.Nodes, up, &serviceInstancesAlive, &serviceInstancesTotal)
+			upstream.Datacenter = up.ServingDatacenter
+			if up.Peer == "" && len(up.Nodes) > 0 {
+				upstream.SNI, upstream.SpiffeID = w.instanceIdentity(up.Nodes[0], up.ServingDatacenter)
 			}
-			if weight == 0 {
-				continue
+			var backupSNI, backupSpiffeID string
+			if len(up.BackupNodes) > 0 {
+				backupSNI, backupSpiffeID = w.instanceIdentity(up.BackupNodes[0], up.BackupDatacenter)
 			}
-			serviceInstancesAlive++
-
-			upstream.Nodes = append(upstream.Nodes, UpstreamNode{
-				Host:   host,
-				Port:   s.Service.Port,
-				Weight: weight,
-			})
+			// backups are not counted as instances of the upstream, and
+			// reached with their address in the other datacenter
+			backupsAlive, backupsTotal := 0, 0
+			for _, n := range w.genUpstreamNodes(up.BackupNodes, up, &backupsAlive, &backupsTotal) {
+				n.Backup = true
+				if backupSNI != upstream.SNI {
+					n.SNI = backupSNI
+				}
+				if backupSpiffeID != upstream.SpiffeID {
+					n.SpiffeID = backupSpiffeID
+				}
+				upstream.Nodes = append(upstream.Nodes, n)
+			}
+		case isSimpleChain(up.Chain):
+			for _, t := range up.Targets {
+				upstream.SNI, upstream.SpiffeID = w.targetIdentity(t.Target)
+				upstream.Nodes = w.genUpstreamNodes(t.Nodes, up, &serviceInstancesAlive, &serviceInstancesTotal)
+			}
+		default:
+			upstream.Routes = chainRoutes(up.Chain)
+			upstream.Targets = w.genUpstreamTargets(up, routesTargets(upstream.Routes), chainConnectTimeouts(up.Chain), chainFailovers(up.Chain), &serviceInstancesAlive, &serviceInstancesTotal)
 		}
 
 		config.Upstreams = append(config.Upstreams, upstream)
@@ -563,9 +1145,197 @@ func (w *Watcher) genCfg() Config {
 		return config.Upstreams[i].Name < config.Upstreams[j].Name
 	})
 
+	config.Intentions = w.genIntentions()
+	config.IntentionsDefaultAllow = w.intentionsDefaultAllow
+
+	switch w.gateway {
+	case GatewayTerminating:
+		config.TerminatingServices = w.genTerminatingServices(&serviceInstancesAlive, &serviceInstancesTotal)
+	case GatewayMesh:
+		config.MeshGatewayRoutes = w.genMeshGatewayRoutes(&serviceInstancesAlive, &serviceInstancesTotal)
+	}
+
 	return config
 }
 
+// instanceIdentity returns the SNI and SPIFFE ID of the service of the
+// instance s in dc, as returned by prepared queries
+func (w *Watcher) instanceIdentity(s *api.ServiceEntry, dc string) (string, string) {
+	service := s.Service.Service
+	if s.Service.Kind == api.ServiceKindConnectProxy && s.Service.Proxy != nil {
+		service = s.Service.Proxy.DestinationServiceName
+	}
+	return w.targetIdentity(&api.DiscoveryTarget{
+		Service:    service,
+		Namespace:  s.Service.Namespace,
+		Datacenter: dc,
+	})
+}
+
+func (w *Watcher) genUpstreamTargets(up *upstream, ids []string, timeouts map[string]time.Duration, failovers map[string][]string, alive, total *int) []UpstreamTarget {
+	targets := make([]UpstreamTarget, 0, len(ids))
+	for _, id := range ids {
+		target := UpstreamTarget{
+			Name:           id,
+			ConnectTimeout: timeouts[id],
+		}
+		if t, ok := up.Targets[id]; ok {
+			target.SNI, target.SpiffeID = w.targetIdentity(t.Target)
+			target.Balance = up.Settings.Balances[t.Target.Service]
+			target.Nodes = w.genUpstreamNodes(t.Nodes, up, alive, total)
+			target.Nodes = append(target.Nodes, w.genFailoverNodes(up, target, failovers[id])...)
+		}
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// genFailoverNodes returns the instances of the failover targets, ids, of
+// target as backups, with their own identity when it differs from the one
+// of target. Instances already in target are skipped, as HAProxy servers
+// are identified by their address.
+func (w *Watcher) genFailoverNodes(up *upstream, target UpstreamTarget, ids []string) []UpstreamNode {
+	seen := map[string]bool{}
+	for _, n := range target.Nodes {
+		seen[fmt.Sprintf("%s:%d", n.Host, n.Port)] = true
+	}
+
+	var res []UpstreamNode
+	for _, id := range ids {
+		t, ok := up.Targets[id]
+		if !ok {
+			continue
+		}
+		sni, spiffeID := w.targetIdentity(t.Target)
+
+		// backups are not counted as instances of the upstream
+		alive, total := 0, 0
+		for _, n := range w.genUpstreamNodes(t.Nodes, up, &alive, &total) {
+			addr := fmt.Sprintf("%s:%d", n.Host, n.Port)
+			if seen[addr] {
+				continue
+			}
+			seen[addr] = true
+
+			n.Backup = true
+			if sni != target.SNI {
+				n.SNI = sni
+			}
+			if spiffeID != target.SpiffeID {
+				n.SpiffeID = spiffeID
+			}
+			res = append(res, n)
+		}
+	}
+	return res
+}
+
+// targetIdentity returns the SNI and the SPIFFE ID of the instances of target
+func (w *Watcher) targetIdentity(target *api.DiscoveryTarget) (string, string) {
+	dc := target.Datacenter
+	if dc == "" {
+		dc = w.datacenter
+	}
+	ns := target.Namespace
+	if ns == "" {
+		ns = DefaultNamespace
+	}
+
+	sni := target.SNI
+	if sni == "" {
+		sni = connect.ServiceSNI(target.Service, target.ServiceSubset, ns, dc, w.trustDomain)
+	}
+
+	id := &SpiffeID{
+		Host:       w.trustDomain,
+		Partition:  w.partition,
+		Namespace:  ns,
+		Datacenter: dc,
+		Service:    target.Service,
+	}
+
+	return sni, id.String()
+}
+
+// genUpstreamNodes converts the instances of up, or of a gateway when nil,
+// to the nodes traffic is balanced to
+func (w *Watcher) genUpstreamNodes(nodes []*api.ServiceEntry, up *upstream, alive, total *int) []UpstreamNode {
+	var res []UpstreamNode
+	var entries []*api.ServiceEntry
+	var warning []bool
+	passing := 0
+	if up != nil {
+		nodes = w.upstreamAddresses(up, nodes)
+	}
+	for _, s := range nodes {
+		*total++
+		host := s.Service.Address
+		if host == "" {
+			host = s.Node.Address
+		}
+
+		weight := 1
+		status := s.Checks.AggregatedStatus()
+		switch status {
+		case api.HealthPassing:
+			weight = s.Service.Weights.Passing
+		case api.HealthWarning:
+			weight = s.Service.Weights.Warning
+		default:
+			continue
+		}
+		if weight == 0 {
+			continue
+		}
+		*alive++
+		if status == api.HealthPassing {
+			passing++
+		}
+		warning = append(warning, status == api.HealthWarning)
+
+		res = append(res, UpstreamNode{
+			Host:   host,
+			Port:   s.Service.Port,
+			Weight: weight,
+		})
+		entries = append(entries, s)
+	}
+
+	if up != nil {
+		up.Settings.Locality.markBackups(res, entries)
+		w.applyRTT(up.Settings.RTT, res, entries)
+
+		// when all instances are in warning, they are all used
+		if passing > 0 && up.Settings.WarningAsBackup {
+			for i := range res {
+				res[i].Backup = res[i].Backup || warning[i]
+			}
+		}
+	}
+
+	return res
+}
+
+// warningAsBackup returns whether the instances of up in warning are only
+// used as backups, from its warning_as_backup config
+func (w *Watcher) warningAsBackup(up *upstream) bool {
+	v, ok := w.configValue("warning_as_backup", up.Config, "")
+	if !ok {
+		return false
+	}
+	switch b := v.(type) {
+	case bool:
+		return b
+	case string:
+		res, err := strconv.ParseBool(b)
+		if err == nil {
+			return res
+		}
+	}
+	w.log.Errorf("upstream %s: bad warning_as_backup value in config: %v. Using default: false", up.Name, v)
+	return false
+}
+
 func (w *Watcher) notifyChanged() {
 	select {
 	case w.update <- struct{}{}:
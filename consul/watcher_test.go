@@ -29,6 +29,8 @@ func startAgent(t *testing.T, sd *lib.Shutdown) *api.Client {
 	return client
 }
 
+// clearCerts clears the certificates and the identities, which depend on
+// the trust domain of the test agent
 func clearCerts(cfg *Config) {
 	cfg.Downstream.CAs = nil
 	cfg.Downstream.Cert = nil
@@ -37,6 +39,8 @@ func clearCerts(cfg *Config) {
 		cfg.Upstreams[i].CAs = nil
 		cfg.Upstreams[i].Cert = nil
 		cfg.Upstreams[i].Key = nil
+		cfg.Upstreams[i].SNI = ""
+		cfg.Upstreams[i].SpiffeID = ""
 	}
 }
 
@@ -58,8 +62,9 @@ var testCases = []struct {
 			},
 		},
 		expected: Config{
-			ServiceName: "client",
-			ServiceID:   "client-inst",
+			ServiceName:            "client",
+			ServiceID:              "client-inst",
+			IntentionsDefaultAllow: true,
 			Downstream: Downstream{
 				LocalBindAddress: "0.0.0.0",
 				LocalBindPort:    21000,
@@ -88,8 +93,9 @@ var testCases = []struct {
 			},
 		},
 		expected: Config{
-			ServiceName: "client",
-			ServiceID:   "client-inst",
+			ServiceName:            "client",
+			ServiceID:              "client-inst",
+			IntentionsDefaultAllow: true,
 			Downstream: Downstream{
 				LocalBindAddress: "0.0.0.0",
 				LocalBindPort:    21000,
@@ -126,8 +132,9 @@ var testCases = []struct {
 			},
 		},
 		expected: Config{
-			ServiceName: "client",
-			ServiceID:   "client-inst",
+			ServiceName:            "client",
+			ServiceID:              "client-inst",
+			IntentionsDefaultAllow: true,
 			Downstream: Downstream{
 				LocalBindAddress: "0.0.0.0",
 				LocalBindPort:    21000,
@@ -143,6 +150,7 @@ var testCases = []struct {
 					LocalBindPort:    8082,
 					ConnectTimeout:   DefaultConnectTimeout,
 					ReadTimeout:      DefaultReadTimeout,
+					Datacenter:       "dc1",
 				},
 				{
 					Name:             "service_server",
@@ -188,8 +196,9 @@ var testCases = []struct {
 			},
 		},
 		expected: Config{
-			ServiceName: "client",
-			ServiceID:   "client-inst",
+			ServiceName:            "client",
+			ServiceID:              "client-inst",
+			IntentionsDefaultAllow: true,
 			Downstream: Downstream{
 				LocalBindAddress: "0.0.0.0",
 				LocalBindPort:    21000,
@@ -205,6 +214,7 @@ var testCases = []struct {
 					LocalBindPort:    8082,
 					ConnectTimeout:   3 * time.Minute,
 					ReadTimeout:      4 * time.Minute,
+					Datacenter:       "dc1",
 				},
 				{
 					Name:             "service_server",
@@ -327,8 +337,9 @@ func TestWatcherConfigUpdate(t *testing.T) {
 	}()
 
 	expected := Config{
-		ServiceName: "client",
-		ServiceID:   "client-inst",
+		ServiceName:            "client",
+		ServiceID:              "client-inst",
+		IntentionsDefaultAllow: true,
 		Downstream: Downstream{
 			LocalBindAddress: "0.0.0.0",
 			LocalBindPort:    21000,
@@ -383,8 +394,9 @@ func TestWatcherConfigUpdate(t *testing.T) {
 	require.NoError(t, err)
 
 	expected = Config{
-		ServiceName: "client",
-		ServiceID:   "client-inst",
+		ServiceName:            "client",
+		ServiceID:              "client-inst",
+		IntentionsDefaultAllow: true,
 		Downstream: Downstream{
 			LocalBindAddress: "0.0.0.0",
 			LocalBindPort:    21000,
@@ -412,3 +424,362 @@ func TestWatcherConfigUpdate(t *testing.T) {
 		require.Equal(t, expected, cfg)
 	}
 }
+
+func TestWatcherDiscoveryChain(t *testing.T) {
+	sd := lib.NewShutdown()
+	defer sd.Shutdown("test end")
+
+	consul := startAgent(t, sd)
+
+	entries := []api.ConfigEntry{
+		&api.ServiceConfigEntry{
+			Kind:     api.ServiceDefaults,
+			Name:     "server",
+			Protocol: "http",
+		},
+		&api.ServiceResolverConfigEntry{
+			Kind: api.ServiceResolver,
+			Name: "server",
+			Subsets: map[string]api.ServiceResolverSubset{
+				"v1": {Filter: "Service.Meta.version == v1"},
+				"v2": {Filter: "Service.Meta.version == v2"},
+			},
+		},
+		&api.ServiceSplitterConfigEntry{
+			Kind: api.ServiceSplitter,
+			Name: "server",
+			Splits: []api.ServiceSplit{
+				{Weight: 90, ServiceSubset: "v1"},
+				{Weight: 10, ServiceSubset: "v2"},
+			},
+		},
+	}
+	for _, e := range entries {
+		_, _, err := consul.ConfigEntries().Set(e, nil)
+		require.NoError(t, err)
+	}
+
+	err := consul.Agent().ServiceRegister(&api.AgentServiceRegistration{
+		Name: "client",
+		ID:   "client-inst",
+		Port: 8080,
+		Connect: &api.AgentServiceConnect{
+			SidecarService: &api.AgentServiceRegistration{
+				Proxy: &api.AgentServiceConnectProxyConfig{
+					Upstreams: []api.Upstream{
+						{
+							DestinationType: "service",
+							DestinationName: "server",
+							LocalBindPort:   8081,
+							Config: map[string]interface{}{
+								"protocol": "http",
+							},
+						},
+					},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	w := New("client-inst", consul, log.New())
+
+	errs := make(chan error)
+	go func() {
+		err := w.Run()
+		if err != nil {
+			errs <- err
+		}
+	}()
+
+	select {
+	case err := <-errs:
+		require.NoError(t, err)
+	case cfg := <-w.C:
+		require.Len(t, cfg.Upstreams, 1)
+		up := cfg.Upstreams[0]
+		require.Empty(t, up.Nodes)
+		require.Len(t, up.Targets, 2)
+		require.Equal(t, []UpstreamRoute{
+			{
+				Splits: []UpstreamSplit{
+					{Weight: 90, Target: "v1.server.default.dc1"},
+					{Weight: 10, Target: "v2.server.default.dc1"},
+				},
+			},
+		}, up.Routes)
+	}
+}
+
+func TestWatcherConfigEntries(t *testing.T) {
+	sd := lib.NewShutdown()
+	defer sd.Shutdown("test end")
+
+	consul := startAgent(t, sd)
+
+	entries := []api.ConfigEntry{
+		&api.ProxyConfigEntry{
+			Kind: api.ProxyDefaults,
+			Name: api.ProxyConfigGlobal,
+			Config: map[string]interface{}{
+				"protocol":        "http",
+				"connect_timeout": "10s",
+			},
+		},
+		&api.ServiceConfigEntry{
+			Kind:     api.ServiceDefaults,
+			Name:     "server",
+			Protocol: "tcp",
+		},
+	}
+	for _, e := range entries {
+		_, _, err := consul.ConfigEntries().Set(e, nil)
+		require.NoError(t, err)
+	}
+
+	err := consul.Agent().ServiceRegister(&api.AgentServiceRegistration{
+		Name: "client",
+		ID:   "client-inst",
+		Port: 8080,
+		Connect: &api.AgentServiceConnect{
+			SidecarService: &api.AgentServiceRegistration{
+				Proxy: &api.AgentServiceConnectProxyConfig{
+					Config: map[string]interface{}{
+						"read_timeout": "1m",
+					},
+					Upstreams: []api.Upstream{
+						{
+							DestinationType: "service",
+							DestinationName: "server",
+							LocalBindPort:   8081,
+							Config: map[string]interface{}{
+								"connect_timeout": "2s",
+							},
+						},
+					},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	w := New("client-inst", consul, log.New())
+
+	errs := make(chan error)
+	go func() {
+		err := w.Run()
+		if err != nil {
+			errs <- err
+		}
+	}()
+
+	select {
+	case err := <-errs:
+		require.NoError(t, err)
+	case cfg := <-w.C:
+		require.Equal(t, "http", cfg.Downstream.Protocol)
+		require.Equal(t, 10*time.Second, cfg.Downstream.ConnectTimeout)
+		require.Equal(t, time.Minute, cfg.Downstream.ReadTimeout)
+
+		require.Len(t, cfg.Upstreams, 1)
+		require.Equal(t, "tcp", cfg.Upstreams[0].Protocol)
+		require.Equal(t, 2*time.Second, cfg.Upstreams[0].ConnectTimeout)
+		require.Equal(t, DefaultReadTimeout, cfg.Upstreams[0].ReadTimeout)
+	}
+}
+
+func TestWatcherUpstreamIdentity(t *testing.T) {
+	sd := lib.NewShutdown()
+	defer sd.Shutdown("test end")
+
+	consul := startAgent(t, sd)
+
+	roots, _, err := consul.Agent().ConnectCARoots(nil)
+	require.NoError(t, err)
+
+	err = consul.Agent().ServiceRegister(&api.AgentServiceRegistration{
+		Name: "client",
+		ID:   "client-inst",
+		Port: 8080,
+		Connect: &api.AgentServiceConnect{
+			SidecarService: &api.AgentServiceRegistration{
+				Proxy: &api.AgentServiceConnectProxyConfig{
+					Upstreams: []api.Upstream{
+						{
+							DestinationType: "service",
+							DestinationName: "server",
+							LocalBindPort:   8081,
+						},
+					},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	w := New("client-inst", consul, log.New())
+
+	errs := make(chan error)
+	go func() {
+		err := w.Run()
+		if err != nil {
+			errs <- err
+		}
+	}()
+
+	select {
+	case err := <-errs:
+		require.NoError(t, err)
+	case cfg := <-w.C:
+		require.Len(t, cfg.Upstreams, 1)
+		require.Equal(t, "server.default.dc1.internal."+roots.TrustDomain, cfg.Upstreams[0].SNI)
+		require.Equal(t, "spiffe://"+roots.TrustDomain+"/ns/default/dc/dc1/svc/server", cfg.Upstreams[0].SpiffeID)
+	}
+}
+
+func TestUpstreamName(t *testing.T) {
+	for _, tc := range []struct {
+		up       api.Upstream
+		peer     string
+		legacy   string
+		expected string
+	}{
+		{
+			up:       api.Upstream{DestinationType: "service", DestinationName: "db", LocalBindPort: 8081},
+			legacy:   "service_db",
+			expected: "service_db_8081",
+		},
+		{
+			up:       api.Upstream{DestinationType: "service", DestinationName: "db", Datacenter: "dc2", LocalBindPort: 8082},
+			legacy:   "service_db",
+			expected: "service_db_dc_dc2_8082",
+		},
+		{
+			up:       api.Upstream{DestinationType: "service", DestinationName: "db", DestinationNamespace: "team", LocalBindAddress: "127.0.0.2", LocalBindPort: 8081},
+			legacy:   "service_team_db",
+			expected: "service_db_ns_team_127.0.0.2_8081",
+		},
+		{
+			up:       api.Upstream{DestinationType: "service", DestinationName: "db", LocalBindPort: 8081},
+			peer:     "other/org",
+			legacy:   "service_db_peer_other/org",
+			expected: "service_db_peer_other:2forg_8081",
+		},
+		{
+			// legacy names are kept as they were, unescaped
+			up:       api.Upstream{DestinationType: "service", DestinationName: "db_a", LocalBindPort: 8081},
+			legacy:   "service_db_a",
+			expected: "service_db:5fa_8081",
+		},
+	} {
+		require.Equal(t, tc.legacy, legacyUpstreamName(tc.up, tc.peer))
+		require.Equal(t, tc.expected, upstreamName(tc.up, tc.peer))
+	}
+}
+
+func TestUpstreamNames(t *testing.T) {
+	require.Equal(t, []string{
+		"service_db_8081",
+		"service_db_dc_dc2_8082",
+		"service_web",
+		"service_web_peer_other",
+	}, upstreamNames([]api.Upstream{
+		{DestinationType: "service", DestinationName: "db", LocalBindPort: 8081},
+		{DestinationType: "service", DestinationName: "db", Datacenter: "dc2", LocalBindPort: 8082},
+		{DestinationType: "service", DestinationName: "web", LocalBindPort: 8083},
+		{DestinationType: "service", DestinationName: "web", LocalBindPort: 8084},
+	}, []string{"", "", "", "other"}))
+
+	// a legacy name cannot take the qualified name of another upstream
+	require.Equal(t, []string{
+		"service_db_8081",
+		"service_db_8082",
+		"service_db:5f8081_9000",
+	}, upstreamNames([]api.Upstream{
+		{DestinationType: "service", DestinationName: "db", LocalBindPort: 8081},
+		{DestinationType: "service", DestinationName: "db", LocalBindPort: 8082},
+		{DestinationType: "service", DestinationName: "db_8081", LocalBindPort: 9000},
+	}, nil))
+}
+
+func TestPreparedQueryFailoverBackups(t *testing.T) {
+	entry := func(host string) *api.ServiceEntry {
+		return &api.ServiceEntry{
+			Node: &api.Node{Address: host},
+			Service: &api.AgentService{
+				Kind:    api.ServiceKindConnectProxy,
+				Service: "db-sidecar-proxy",
+				Port:    8080,
+				Weights: api.AgentWeights{Passing: 1},
+				Proxy:   &api.AgentServiceConnectProxyConfig{DestinationServiceName: "db"},
+			},
+		}
+	}
+
+	backup := entry("2.2.2.2")
+	backup.Node.Datacenter = "dc2"
+	backup.Node.TaggedAddresses = map[string]string{"wan": "3.3.3.3"}
+
+	w := New("client-inst", nil, NewTestingLogger(t))
+	w.leaf = &certLeaf{}
+	w.datacenter = "dc1"
+	w.trustDomain = "test.consul"
+	w.upstreams["pq"] = &upstream{
+		Name:              "pq",
+		Nodes:             []*api.ServiceEntry{entry("1.1.1.1")},
+		BackupNodes:       []*api.ServiceEntry{backup},
+		BackupDatacenter:  "dc2",
+		ServingDatacenter: "dc1",
+	}
+
+	cfg := w.genCfg()
+	require.Len(t, cfg.Upstreams, 1)
+	require.Equal(t, "dc1", cfg.Upstreams[0].Datacenter)
+	require.Equal(t, "db.default.dc1.internal.test.consul", cfg.Upstreams[0].SNI)
+	require.Equal(t, "spiffe://test.consul/ns/default/dc/dc1/svc/db", cfg.Upstreams[0].SpiffeID)
+	require.Equal(t, []UpstreamNode{
+		{Host: "1.1.1.1", Port: 8080, Weight: 1},
+		{
+			Host:     "3.3.3.3",
+			Port:     8080,
+			Weight:   1,
+			Backup:   true,
+			SNI:      "db.default.dc2.internal.test.consul",
+			SpiffeID: "spiffe://test.consul/ns/default/dc/dc2/svc/db",
+		},
+	}, cfg.Upstreams[0].Nodes)
+}
+
+func TestWarningAsBackup(t *testing.T) {
+	entry := func(host, status string) *api.ServiceEntry {
+		return &api.ServiceEntry{
+			Node:    &api.Node{Address: host},
+			Service: &api.AgentService{Port: 8080, Weights: api.AgentWeights{Passing: 10, Warning: 1}},
+			Checks:  api.HealthChecks{{Status: status}},
+		}
+	}
+	passing := entry("1.1.1.1", api.HealthPassing)
+	warning := entry("1.1.1.2", api.HealthWarning)
+	critical := entry("1.1.1.3", api.HealthCritical)
+
+	w := &Watcher{log: NewTestingLogger(t)}
+
+	var alive, total int
+	up := &upstream{Name: "up"}
+	require.Equal(t, []UpstreamNode{
+		{Host: "1.1.1.1", Port: 8080, Weight: 10},
+		{Host: "1.1.1.2", Port: 8080, Weight: 1},
+	}, w.genUpstreamNodes([]*api.ServiceEntry{passing, warning, critical}, up, &alive, &total))
+
+	up.Config = map[string]interface{}{"warning_as_backup": true}
+	w.updateUpstreamSettings(up)
+	require.Equal(t, []UpstreamNode{
+		{Host: "1.1.1.1", Port: 8080, Weight: 10},
+		{Host: "1.1.1.2", Port: 8080, Weight: 1, Backup: true},
+	}, w.genUpstreamNodes([]*api.ServiceEntry{passing, warning, critical}, up, &alive, &total))
+
+	// with no passing instance, warning ones are used
+	require.Equal(t, []UpstreamNode{
+		{Host: "1.1.1.2", Port: 8080, Weight: 1},
+	}, w.genUpstreamNodes([]*api.ServiceEntry{warning, critical}, up, &alive, &total))
+}
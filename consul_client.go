@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/haproxy-consul-connect/lib"
+)
+
+// consulFlags configure the consul client on top of the CONSUL_HTTP_*
+// environment variables
+type consulFlags struct {
+	addr          *string
+	namespace     *string
+	token         *string
+	tokenFile     *string
+	caFile        *string
+	clientCert    *string
+	clientKey     *string
+	tlsServerName *string
+
+	authMethod      *string
+	bearerTokenFile *string
+}
+
+func registerConsulFlags(flags *flag.FlagSet) *consulFlags {
+	return &consulFlags{
+		addr:          flags.String("http-addr", "", "Consul agent address, https:// to use TLS (default CONSUL_HTTP_ADDR or 127.0.0.1:8500)"),
+		namespace:     flags.String("namespace", "", "Consul Enterprise namespace of the proxied service (default CONSUL_NAMESPACE)"),
+		token:         flags.String("token", "", "Consul ACL token (default CONSUL_HTTP_TOKEN)"),
+		tokenFile:     flags.String("token-file", os.Getenv("CONSUL_HTTP_TOKEN_FILE"), "File containing the Consul ACL token, reloaded on change"),
+		caFile:        flags.String("ca-file", "", "CA verifying the Consul agent certificate (default CONSUL_CACERT)"),
+		clientCert:    flags.String("client-cert", "", "Client certificate presented to the Consul agent (default CONSUL_CLIENT_CERT)"),
+		clientKey:     flags.String("client-key", "", "Key of the client certificate (default CONSUL_CLIENT_KEY)"),
+		tlsServerName: flags.String("tls-server-name", "", "Server name verified in the Consul agent certificate (default CONSUL_TLS_SERVER_NAME)"),
+
+		authMethod:      flags.String("acl-auth-method", "", "ACL auth method to log in with instead of using a static token"),
+		bearerTokenFile: flags.String("acl-bearer-token-file", "", "File containing the bearer token exchanged through the ACL auth method"),
+	}
+}
+
+// client builds a consul client, and an http client for the requests it
+// cannot make, watching the token file or logging in with the auth method,
+// and logging out on shutdown
+func (f *consulFlags) client(sd *lib.Shutdown) (*api.Client, *consul.HTTPClient, error) {
+	cfg := api.DefaultConfig()
+	if *f.addr != "" {
+		cfg.Address = *f.addr
+	}
+	if *f.namespace != "" {
+		cfg.Namespace = *f.namespace
+	}
+	if *f.token != "" {
+		cfg.Token = *f.token
+	}
+	if *f.caFile != "" {
+		cfg.TLSConfig.CAFile = *f.caFile
+	}
+	if *f.clientCert != "" {
+		cfg.TLSConfig.CertFile = *f.clientCert
+	}
+	if *f.clientKey != "" {
+		cfg.TLSConfig.KeyFile = *f.clientKey
+	}
+	if *f.tlsServerName != "" {
+		cfg.TLSConfig.Address = *f.tlsServerName
+	}
+
+	var transport *consul.TokenTransport
+	switch {
+	case *f.tokenFile != "" && *f.authMethod != "":
+		return nil, nil, errors.New("-token-file and -acl-auth-method are mutually exclusive")
+	case *f.tokenFile != "":
+		tokenFile, err := consul.NewTokenFile(*f.tokenFile, &consulLogger{}, sd.Stop)
+		if err != nil {
+			return nil, nil, err
+		}
+		transport = &consul.TokenTransport{
+			Token: tokenFile.Token,
+		}
+	case *f.authMethod != "":
+		if *f.bearerTokenFile == "" {
+			return nil, nil, errors.New("-acl-bearer-token-file is required with -acl-auth-method")
+		}
+		cfg.Token = ""
+		loginCfg := *cfg
+		loginClient, err := api.NewClient(&loginCfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		login, err := consul.NewLogin(loginClient, *f.authMethod, *f.bearerTokenFile, &consulLogger{})
+		if err != nil {
+			return nil, nil, err
+		}
+		sd.Add(1)
+		go func() {
+			defer sd.Done()
+			<-sd.Stop
+			err := login.Logout()
+			if err != nil {
+				log.Errorf("error logging out of consul: %s", err)
+			}
+		}()
+		transport = &consul.TokenTransport{
+			Token:   login.Token,
+			Refresh: login.Refresh,
+		}
+	}
+
+	httpClient, err := api.NewHttpClient(cfg.Transport, cfg.TLSConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	if transport != nil {
+		transport.Base = httpClient.Transport
+		httpClient.Transport = transport
+	}
+	cfg.HttpClient = httpClient
+
+	raw := &consul.HTTPClient{
+		Client:  httpClient,
+		Scheme:  cfg.Scheme,
+		Address: cfg.Address,
+		Token:   cfg.Token,
+	}
+	if parts := strings.SplitN(cfg.Address, "://", 2); len(parts) == 2 {
+		raw.Scheme = parts[0]
+		raw.Address = parts[1]
+	}
+
+	client, err := api.NewClient(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return client, raw, nil
+}
@@ -9,6 +9,7 @@ require (
 	github.com/haproxytech/models/v2 v2.1.0
 	github.com/hashicorp/consul v1.7.2
 	github.com/hashicorp/consul/api v1.4.0
+	github.com/hashicorp/go-bexpr v0.1.2
 	github.com/phayes/freeport v0.0.0-20180830031419-95f893ade6f2 // indirect
 	github.com/pkg/errors v0.9.1
 	github.com/prometheus/client_golang v0.9.2
@@ -0,0 +1,139 @@
+package haproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	auditLogStdout       = "stdout"
+	auditLogSyslogPrefix = "syslog://"
+	auditLogBackups      = 3
+)
+
+// AuditEntry records an authorization decision of the SPOE agent
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	SourceID   string    `json:"source_id"`
+	CertSerial string    `json:"cert_serial"`
+	SourceIP   string    `json:"source_ip,omitempty"`
+	Target     string    `json:"target"`
+	Method     string    `json:"method,omitempty"`
+	Path       string    `json:"path,omitempty"`
+	Decision   string    `json:"decision"`
+	// CertCached is set when the source certificate was decoded from the
+	// cache, decisions are never cached
+	CertCached bool `json:"cert_cached"`
+}
+
+// AuditLog writes authorization decisions as JSON lines
+type AuditLog struct {
+	lock sync.Mutex
+	w    io.WriteCloser
+
+	// set when writing to a file rotated after maxSize bytes
+	path    string
+	maxSize int64
+	size    int64
+}
+
+// NewAuditLog opens an audit log writing to stdout, to a syslog address
+// given as syslog://host:port or to a file rotated when it grows larger than
+// maxSize bytes, 0 disabling rotation
+func NewAuditLog(dest string, maxSize int64) (*AuditLog, error) {
+	switch {
+	case dest == auditLogStdout:
+		return &AuditLog{w: nopCloser{os.Stdout}}, nil
+	case strings.HasPrefix(dest, auditLogSyslogPrefix):
+		w, err := syslog.Dial("udp", strings.TrimPrefix(dest, auditLogSyslogPrefix), syslog.LOG_INFO|syslog.LOG_LOCAL0, "haproxy-connect-audit")
+		if err != nil {
+			return nil, err
+		}
+		return &AuditLog{w: w}, nil
+	default:
+		l := &AuditLog{
+			path:    dest,
+			maxSize: maxSize,
+		}
+		err := l.open()
+		if err != nil {
+			return nil, err
+		}
+		return l, nil
+	}
+}
+
+func (l *AuditLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.w = f
+	l.size = info.Size()
+	return nil
+}
+
+// rotate shifts the backups of the log file, dropping the oldest one, and
+// reopens an empty file
+func (l *AuditLog) rotate() error {
+	err := l.w.Close()
+	if err != nil {
+		return err
+	}
+	for i := auditLogBackups - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	err = os.Rename(l.path, l.path+".1")
+	if err != nil {
+		return err
+	}
+	return l.open()
+}
+
+func (l *AuditLog) Log(e AuditEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.path != "" && l.maxSize > 0 && l.size+int64(len(b)) > l.maxSize && l.size > 0 {
+		err := l.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := l.w.Write(b)
+	l.size += int64(n)
+	return err
+}
+
+func (l *AuditLog) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.w.Close()
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,48 @@
+package haproxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	logPath := path.Join(dir, "audit.log")
+	l, err := NewAuditLog(logPath, 300)
+	require.NoError(t, err)
+	defer l.Close()
+
+	e := AuditEntry{
+		Time:       time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		SourceID:   "spiffe://11111111-2222-3333-4444-555555555555.consul/ns/default/dc/dc1/svc/web",
+		CertSerial: "42",
+		SourceIP:   "10.0.0.1",
+		Target:     "db",
+		Decision:   "allow",
+	}
+	require.NoError(t, l.Log(e))
+	e.Decision = "deny"
+	require.NoError(t, l.Log(e))
+
+	rotated, err := ioutil.ReadFile(logPath + ".1")
+	require.NoError(t, err)
+	current, err := ioutil.ReadFile(logPath)
+	require.NoError(t, err)
+
+	var got AuditEntry
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimSpace(string(rotated))), &got))
+	require.Equal(t, "allow", got.Decision)
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimSpace(string(current))), &got))
+	require.Equal(t, "deny", got.Decision)
+	require.Equal(t, "db", got.Target)
+}
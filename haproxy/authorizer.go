@@ -0,0 +1,44 @@
+package haproxy
+
+import (
+	"net/http"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+)
+
+// AuthRequest is a connection, or an HTTP request when HTTP is set, from the
+// Source service to the Target service. TargetNamespace is empty when consul
+// does not support namespaces. HTTPChecked is set for the connections whose
+// HTTP requests are authorized as well.
+type AuthRequest struct {
+	Source          *consul.SpiffeID
+	Target          string
+	TargetNamespace string
+	HTTP            *HTTPRequest
+	HTTPChecked     bool
+}
+
+// HTTPRequest holds the attributes of an HTTP request authorizers can use
+type HTTPRequest struct {
+	Method string
+	Path   string
+	Header http.Header
+}
+
+// Authorizer decides whether the SPOE agent allows a request
+type Authorizer interface {
+	Authorize(req AuthRequest) (bool, error)
+}
+
+// ChainAuthorizer allows the requests allowed by all its authorizers
+type ChainAuthorizer []Authorizer
+
+func (c ChainAuthorizer) Authorize(req AuthRequest) (bool, error) {
+	for _, a := range c {
+		ok, err := a.Authorize(req)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
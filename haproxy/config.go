@@ -36,7 +36,7 @@ const spoeConfTmpl = `
 [intentions]
 
 spoe-agent intentions-agent
-	messages check-intentions
+	messages check-intentions check-intentions-http
 
 	option var-prefix connect
 
@@ -47,7 +47,28 @@ spoe-agent intentions-agent
 	use-backend spoe_back
 
 spoe-message check-intentions
-	args ip=src cert=ssl_c_der
+	args ip=src cert=ssl_c_der target=ssl_f_der frontend=fe_name
+	event on-frontend-tcp-request
+
+spoe-message check-intentions-http
+	args ip=src cert=ssl_c_der target=ssl_f_der frontend=fe_name method=method path=path headers=req.hdrs_bin
+	event on-frontend-http-request
+
+[intentions-tcp]
+
+spoe-agent intentions-tcp-agent
+	messages check-intentions-tcp
+
+	option var-prefix connect
+
+	timeout hello      3000ms
+	timeout idle       3000s
+	timeout processing 3000ms
+
+	use-backend spoe_back
+
+spoe-message check-intentions-tcp
+	args ip=src cert=ssl_c_der target=ssl_f_der frontend=fe_name
 	event on-frontend-tcp-request
 
 `
@@ -0,0 +1,30 @@
+package dataplane
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/haproxytech/models/v2"
+)
+
+func (c *Dataplane) BackendSwitchingRules(feName string) ([]models.BackendSwitchingRule, error) {
+	type resT struct {
+		Data []models.BackendSwitchingRule `json:"data"`
+	}
+
+	var res resT
+
+	err := c.makeReq(http.MethodGet, fmt.Sprintf("/v2/services/haproxy/configuration/backend_switching_rules?frontend=%s", feName), nil, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Data, nil
+}
+
+func (t *tnx) CreateBackendSwitchingRule(feName string, rule models.BackendSwitchingRule) error {
+	if err := t.ensureTnx(); err != nil {
+		return err
+	}
+	return t.client.makeReq(http.MethodPost, fmt.Sprintf("/v2/services/haproxy/configuration/backend_switching_rules?frontend=%s&transaction_id=%s", feName, t.txID), rule, nil)
+}
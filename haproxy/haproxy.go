@@ -2,9 +2,7 @@ package haproxy
 
 import (
 	"fmt"
-	"net"
 
-	spoe "github.com/criteo/haproxy-spoe-go"
 	"github.com/haproxytech/haproxy-consul-connect/consul"
 	"github.com/haproxytech/haproxy-consul-connect/haproxy/dataplane"
 	"github.com/haproxytech/haproxy-consul-connect/haproxy/haproxy_cmd"
@@ -64,8 +62,8 @@ func (h *HAProxy) start(sd *lib.Shutdown) error {
 		}
 	}
 
-	if h.opts.EnableIntentions {
-		err := h.startSPOA()
+	if h.opts.EnableIntentions && h.opts.SPOEAddress == "" {
+		err := h.startSPOA(sd)
 		if err != nil {
 			return err
 		}
@@ -118,20 +116,25 @@ func (h *HAProxy) startLogger() error {
 	return nil
 }
 
-func (h *HAProxy) startSPOA() error {
-	spoeAgent := spoe.New(NewSPOEHandler(h.consulClient, func() consul.Config {
+// startSPOA starts the SPOE intentions agent embedded in this process
+func (h *HAProxy) startSPOA(sd *lib.Shutdown) error {
+	handler, err := newSPOEHandler(sd, func() consul.Config {
 		return *h.currentConsulConfig
-	}).Handler)
+	}, h.opts.AuthzPolicyFile, h.opts.AuditLog, h.opts.AuditLogMaxSize)
+	if err != nil {
+		return err
+	}
 
-	lis, err := net.Listen("unix", h.haConfig.SPOESock)
+	lis, err := listenSPOE("unix@"+h.haConfig.SPOESock, nil)
 	if err != nil {
-		log.Fatal("error starting spoe agent:", err)
+		return err
 	}
 
 	go func() {
-		err = spoeAgent.Serve(lis)
+		err := serveSPOE(sd, lis, handler)
 		if err != nil {
-			log.Fatal("error starting spoe agent:", err)
+			log.Error(err)
+			sd.Shutdown(err.Error())
 		}
 	}()
 
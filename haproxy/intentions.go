@@ -0,0 +1,215 @@
+package haproxy
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	log "github.com/sirupsen/logrus"
+)
+
+var regexCache sync.Map
+
+// IntentionsAuthorizer authorizes requests according to the consul intentions
+// of the proxied services
+type IntentionsAuthorizer struct {
+	cfg func() consul.Config
+}
+
+func NewIntentionsAuthorizer(cfg func() consul.Config) *IntentionsAuthorizer {
+	return &IntentionsAuthorizer{
+		cfg: cfg,
+	}
+}
+
+// Authorize implements Authorizer. The first matching intention by precedence
+// decides, or the default policy when none match. Intentions with L7
+// permissions are checked on each request: the first matching permission
+// decides, or the default policy when none match. They allow the connections
+// whose requests are checked, and deny the others as consul does.
+func (a *IntentionsAuthorizer) Authorize(req AuthRequest) (bool, error) {
+	cfg := a.cfg()
+
+	i := matchIntention(cfg, req)
+	if i == nil {
+		return cfg.IntentionsDefaultAllow, nil
+	}
+	if len(i.Permissions) == 0 {
+		return i.Allow, nil
+	}
+	if req.HTTP == nil {
+		return req.HTTPChecked, nil
+	}
+
+	for _, p := range i.Permissions {
+		if p.HTTP == nil || httpPermissionMatch(p.HTTP, req.HTTP) {
+			return p.Allow, nil
+		}
+	}
+
+	return cfg.IntentionsDefaultAllow, nil
+}
+
+// matchIntention returns the first intention matching the request. Sources
+// of intentions without a partition are in the local one.
+func matchIntention(cfg consul.Config, req AuthRequest) *consul.Intention {
+	targetNS := req.TargetNamespace
+	if targetNS == "" {
+		targetNS = consul.DefaultNamespace
+	}
+	localPartition := cfg.Partition
+	if localPartition == "" {
+		localPartition = consul.DefaultPartition
+	}
+	partition := req.Source.Partition
+	if partition == "" {
+		partition = consul.DefaultPartition
+	}
+
+	for i, in := range cfg.Intentions {
+		sourcePartition := in.SourcePartition
+		if sourcePartition == "" {
+			sourcePartition = localPartition
+		}
+		if !intentionNameMatch(in.DestinationName, req.Target) ||
+			!intentionNameMatch(in.DestinationNS, targetNS) ||
+			!intentionNameMatch(in.SourceName, req.Source.Service) ||
+			!intentionNameMatch(in.SourceNS, req.Source.Namespace) ||
+			!intentionNameMatch(sourcePartition, partition) {
+			continue
+		}
+		return &cfg.Intentions[i]
+	}
+
+	return nil
+}
+
+func intentionNameMatch(pattern, name string) bool {
+	return pattern == "*" || pattern == name
+}
+
+func httpPermissionMatch(p *consul.IntentionHTTPPermission, req *HTTPRequest) bool {
+	switch {
+	case p.PathExact != "" && req.Path != p.PathExact:
+		return false
+	case p.PathPrefix != "" && !strings.HasPrefix(req.Path, p.PathPrefix):
+		return false
+	case p.PathRegex != "" && !regexMatch(p.PathRegex, req.Path):
+		return false
+	}
+
+	if len(p.Methods) > 0 {
+		found := false
+		for _, m := range p.Methods {
+			if strings.EqualFold(m, req.Method) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for _, h := range p.Headers {
+		values, present := req.Header[http.CanonicalHeaderKey(h.Name)]
+		value := strings.Join(values, ",")
+
+		var match bool
+		switch {
+		case h.Present:
+			match = present
+		case h.Exact != "":
+			match = present && value == h.Exact
+		case h.Prefix != "":
+			match = present && strings.HasPrefix(value, h.Prefix)
+		case h.Suffix != "":
+			match = present && strings.HasSuffix(value, h.Suffix)
+		case h.Regex != "":
+			match = present && regexMatch(h.Regex, value)
+		default:
+			continue
+		}
+		if match == h.Invert {
+			return false
+		}
+	}
+
+	return true
+}
+
+func regexMatch(expr, s string) bool {
+	re, ok := regexCache.Load(expr)
+	if !ok {
+		compiled, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			log.Errorf("intentions: invalid regex %s: %s", expr, err)
+			return false
+		}
+		re, _ = regexCache.LoadOrStore(expr, compiled)
+	}
+	return re.(*regexp.Regexp).MatchString(s)
+}
+
+// decodeHeaders decodes the headers sent by HAProxy in the req.hdrs_bin
+// format: a list of name and value strings prefixed by their varint length,
+// ending with an empty name and value
+func decodeHeaders(b []byte) (http.Header, error) {
+	headers := http.Header{}
+	for {
+		name, rest, err := decodeString(b)
+		if err != nil {
+			return nil, err
+		}
+		value, rest, err := decodeString(rest)
+		if err != nil {
+			return nil, err
+		}
+		b = rest
+
+		if name == "" && value == "" {
+			return headers, nil
+		}
+		headers.Add(name, value)
+	}
+}
+
+func decodeString(b []byte) (string, []byte, error) {
+	l, b, err := decodeVarint(b)
+	if err != nil {
+		return "", nil, err
+	}
+	if uint64(len(b)) < l {
+		return "", nil, errors.New("truncated headers")
+	}
+	return string(b[:l]), b[l:], nil
+}
+
+// decodeVarint decodes the variable length integers of the SPOE protocol
+func decodeVarint(b []byte) (uint64, []byte, error) {
+	if len(b) == 0 {
+		return 0, nil, errors.New("truncated varint")
+	}
+	v := uint64(b[0])
+	b = b[1:]
+	if v < 240 {
+		return v, b, nil
+	}
+
+	shift := uint(4)
+	for {
+		if len(b) == 0 {
+			return 0, nil, errors.New("truncated varint")
+		}
+		c := b[0]
+		b = b[1:]
+		v += uint64(c) << shift
+		shift += 7
+		if c < 128 {
+			return v, b, nil
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package haproxy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIntentionsAuthorizer(t *testing.T) {
+	cfg := consul.Config{
+		Intentions: []consul.Intention{
+			{SourceNS: "default", SourceName: "web", DestinationNS: "default", DestinationName: "db", Allow: true, Precedence: 9},
+			{SourceNS: "default", SourceName: "*", DestinationNS: "default", DestinationName: "db", Allow: false, Precedence: 8},
+			{SourceNS: "*", SourceName: "*", DestinationNS: "default", DestinationName: "*", Allow: true, Precedence: 5},
+		},
+		IntentionsDefaultAllow: false,
+	}
+
+	source := func(name string) *consul.SpiffeID {
+		return &consul.SpiffeID{Namespace: "default", Datacenter: "dc1", Service: name}
+	}
+
+	a := NewIntentionsAuthorizer(func() consul.Config { return cfg })
+	authorize := func(target string, source *consul.SpiffeID) bool {
+		ok, err := a.Authorize(AuthRequest{Source: source, Target: target})
+		require.NoError(t, err)
+		return ok
+	}
+
+	require.True(t, authorize("db", source("web")))
+	require.False(t, authorize("db", source("api")))
+	require.True(t, authorize("cache", source("api")))
+
+	cfg.Intentions = nil
+	require.False(t, authorize("db", source("web")))
+	cfg.IntentionsDefaultAllow = true
+	require.True(t, authorize("db", source("web")))
+}
+
+func TestIntentionsAuthorizerNamespaces(t *testing.T) {
+	cfg := consul.Config{
+		Partition: "team",
+		Intentions: []consul.Intention{
+			{SourceNS: "frontend", SourceName: "web", DestinationNS: "backend", DestinationName: "db", Allow: true, Precedence: 9},
+			{SourcePartition: "other", SourceNS: "*", SourceName: "*", DestinationNS: "backend", DestinationName: "db", Allow: true, Precedence: 8},
+		},
+	}
+
+	a := NewIntentionsAuthorizer(func() consul.Config { return cfg })
+	authorize := func(source *consul.SpiffeID, targetNS string) bool {
+		ok, err := a.Authorize(AuthRequest{Source: source, Target: "db", TargetNamespace: targetNS})
+		require.NoError(t, err)
+		return ok
+	}
+
+	require.True(t, authorize(&consul.SpiffeID{Partition: "team", Namespace: "frontend", Service: "web"}, "backend"))
+	require.False(t, authorize(&consul.SpiffeID{Partition: "team", Namespace: "frontend", Service: "web"}, "default"))
+	require.False(t, authorize(&consul.SpiffeID{Partition: "team", Namespace: "default", Service: "web"}, "backend"))
+	require.False(t, authorize(&consul.SpiffeID{Partition: "default", Namespace: "frontend", Service: "web"}, "backend"))
+	require.True(t, authorize(&consul.SpiffeID{Partition: "other", Namespace: "any", Service: "api"}, "backend"))
+}
+
+func TestIntentionsAuthorizerHTTP(t *testing.T) {
+	cfg := consul.Config{
+		Intentions: []consul.Intention{
+			{
+				SourceNS: "default", SourceName: "web", DestinationNS: "default", DestinationName: "api", Precedence: 9,
+				Permissions: []consul.IntentionPermission{
+					{Allow: false, HTTP: &consul.IntentionHTTPPermission{PathPrefix: "/admin"}},
+					{Allow: true, HTTP: &consul.IntentionHTTPPermission{
+						PathRegex: "/v[0-9]+/.*",
+						Methods:   []string{"GET", "HEAD"},
+						Headers:   []consul.UpstreamHeaderMatch{{Name: "x-debug", Present: true, Invert: true}},
+					}},
+				},
+			},
+		},
+	}
+	web := &consul.SpiffeID{Namespace: "default", Datacenter: "dc1", Service: "web"}
+
+	a := NewIntentionsAuthorizer(func() consul.Config { return cfg })
+	authorize := func(req *HTTPRequest) bool {
+		ok, err := a.Authorize(AuthRequest{Source: web, Target: "api", HTTP: req, HTTPChecked: true})
+		require.NoError(t, err)
+		return ok
+	}
+
+	require.True(t, authorize(nil))
+	require.True(t, authorize(&HTTPRequest{Method: "GET", Path: "/v1/users"}))
+	require.False(t, authorize(&HTTPRequest{Method: "POST", Path: "/v1/users"}))
+	require.False(t, authorize(&HTTPRequest{Method: "GET", Path: "/admin/v1/x"}))
+	require.False(t, authorize(&HTTPRequest{
+		Method: "GET",
+		Path:   "/v1/users",
+		Header: http.Header{"X-Debug": []string{"1"}},
+	}))
+}
+
+func TestIntentionsAuthorizerTCP(t *testing.T) {
+	cfg := consul.Config{
+		IntentionsDefaultAllow: true,
+		Intentions: []consul.Intention{
+			{
+				SourceNS: "default", SourceName: "web", DestinationNS: "default", DestinationName: "db", Precedence: 9,
+				Permissions: []consul.IntentionPermission{
+					{Allow: false, HTTP: &consul.IntentionHTTPPermission{PathPrefix: "/"}},
+				},
+			},
+		},
+	}
+	web := &consul.SpiffeID{Namespace: "default", Datacenter: "dc1", Service: "web"}
+
+	// the connections to tcp frontends are denied, their requests are not
+	// checked
+	a := NewIntentionsAuthorizer(func() consul.Config { return cfg })
+	ok, err := a.Authorize(AuthRequest{Source: web, Target: "db"})
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestDecodeHeaders(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	b := []byte{4}
+	b = append(b, "host"...)
+	b = append(b, 3)
+	b = append(b, "web"...)
+	// 300 is encoded as 240|(300&15), (300-240)>>4
+	b = append(b, 5)
+	b = append(b, "x-val"...)
+	b = append(b, 240|byte(300&15), byte((300-240)>>4))
+	b = append(b, long...)
+	b = append(b, 0, 0)
+
+	headers, err := decodeHeaders(b)
+	require.NoError(t, err)
+	require.Equal(t, "web", headers.Get("Host"))
+	require.Equal(t, long, headers.Get("X-Val"))
+
+	_, err = decodeHeaders(b[:10])
+	require.Error(t, err)
+}
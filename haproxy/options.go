@@ -1,11 +1,18 @@
 package haproxy
 
 type Options struct {
-	HAProxyBin           string
-	DataplaneBin         string
-	ConfigBaseDir        string
+	HAProxyBin    string
+	DataplaneBin  string
+	ConfigBaseDir string
+	// SPOEAddress is the address of a standalone SPOE agent to use instead
+	// of the embedded one, reached with TLS when SPOECAFile is set
 	SPOEAddress          string
+	SPOECAFile           string
+	SPOECertFile         string
 	EnableIntentions     bool
+	AuthzPolicyFile      string
+	AuditLog             string
+	AuditLogMaxSize      int64
 	StatsListenAddr      string
 	StatsRegisterService bool
 	LogRequests          bool
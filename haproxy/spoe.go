@@ -3,7 +3,7 @@ package haproxy
 import (
 	"crypto/x509"
 	"fmt"
-	"sync"
+	"net"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -13,49 +13,47 @@ import (
 
 	spoe "github.com/criteo/haproxy-spoe-go"
 	"github.com/haproxytech/haproxy-consul-connect/consul"
-	"github.com/hashicorp/consul/agent/connect"
-	"github.com/hashicorp/consul/api"
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/state"
 	"github.com/pkg/errors"
 )
 
-const (
-	authzTimeout = time.Second
-	cacheTTL     = time.Second
-)
-
 var (
 	certCacheAccess = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "cert_cache_access",
 		Help: "The total number certificate cache access by hit/miss",
 	}, []string{"type"})
-
+	// authCacheAccess is kept for compatibility, intentions being
+	// evaluated locally every authorization is a hit
 	authCacheAccess = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "auth_cache_access",
-		Help: "The total number auth cache access by hit/miss",
+		Help: "Deprecated: the total number auth cache access by hit/miss, always a hit since intentions are evaluated locally",
 	}, []string{"type"})
+	connectionsAllowed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "connections_allowed",
+		Help: "The total number of connections and requests allowed by source service",
+	}, []string{"source"})
+	connectionsDenied = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "connections_denied",
+		Help: "The total number of connections and requests denied by source service",
+	}, []string{"source"})
 )
 
-type cacheEntry struct {
-	Value bool
-	At    time.Time
-	C     chan struct{}
-}
-
 type SPOEHandler struct {
-	c   *api.Client
-	cfg func() consul.Config
+	cfg   func() consul.Config
+	authz Authorizer
+	audit *AuditLog
 
-	certCache     ttlru.Cache
-	authCache     map[string]*cacheEntry
-	authCacheLock sync.Mutex
+	certCache ttlru.Cache
 }
 
-func NewSPOEHandler(c *api.Client, cfg func() consul.Config) *SPOEHandler {
+// NewSPOEHandler returns a handler authorizing requests with authz and
+// recording the decisions in audit when not nil
+func NewSPOEHandler(cfg func() consul.Config, authz Authorizer, audit *AuditLog) *SPOEHandler {
 	return &SPOEHandler{
-		c:         c,
 		cfg:       cfg,
+		authz:     authz,
+		audit:     audit,
 		certCache: ttlru.New(2048, ttlru.WithTTL(time.Minute)),
-		authCache: map[string]*cacheEntry{},
 	}
 }
 
@@ -64,21 +62,47 @@ func (h *SPOEHandler) Handler(msgs *spoe.MessageIterator) ([]spoe.Action, error)
 	for msgs.Next() {
 		m := msgs.Message
 
-		if m.Name != "check-intentions" {
+		switch m.Name {
+		case "check-intentions", "check-intentions-http", "check-intentions-tcp":
+		default:
 			continue
 		}
+		isHTTP := m.Name == "check-intentions-http"
+		req := &HTTPRequest{}
 
-		var certBytes []byte
+		var certBytes, targetCertBytes []byte
+		var frontend string
+		var sourceIP net.IP
 		for m.Args.Next() {
 			arg := m.Args.Arg
 
 			switch arg.Name {
+			case "ip":
+				sourceIP, _ = arg.Value.(net.IP)
+			case "frontend":
+				frontend, _ = arg.Value.(string)
 			case "cert":
 				var ok bool
 				certBytes, ok = arg.Value.([]byte)
 				if !ok {
 					return nil, fmt.Errorf("spoe handler: expected cert bytes in message, got: %+v", m.Args)
 				}
+			case "target":
+				targetCertBytes, _ = arg.Value.([]byte)
+			case "method":
+				req.Method, _ = arg.Value.(string)
+			case "path":
+				req.Path, _ = arg.Value.(string)
+			case "headers":
+				b, ok := arg.Value.([]byte)
+				if !ok {
+					return nil, fmt.Errorf("spoe handler: expected headers bytes in message, got: %+v", m.Args)
+				}
+				headers, err := decodeHeaders(b)
+				if err != nil {
+					return nil, fmt.Errorf("spoe handler: %s", err)
+				}
+				req.Header = headers
 			}
 		}
 
@@ -90,33 +114,79 @@ func (h *SPOEHandler) Handler(msgs *spoe.MessageIterator) ([]spoe.Action, error)
 			return nil, fmt.Errorf("spoe handler: cert is required")
 		}
 
-		cert, err := h.decodeCertificate(certBytes)
+		cert, cached, err := h.decodeCertificate(certBytes)
 		if err != nil {
 			log.Errorf("spoe handler: %s", err)
 			return nil, err
 		}
 
-		certURI, err := connect.ParseCertURI(cert.URIs[0])
-		if err != nil {
+		if len(cert.URIs) == 0 {
 			log.Error("connect: invalid leaf certificate URI")
 			return nil, errors.New("connect: invalid leaf certificate URI")
 		}
 
-		sourceApp := ""
-		authorized, err := h.isAuthorized(cfg.ServiceName, certURI.URI().String(), cert.SerialNumber.Bytes())
+		target, targetNS, err := h.target(cfg, frontend, targetCertBytes)
 		if err != nil {
 			log.Errorf("spoe handler: %s", err)
 			return nil, err
 		}
 
-		if sis, ok := certURI.(*connect.SpiffeIDService); ok {
-			sourceApp = sis.Service
+		sourceApp := ""
+		sourceNS := ""
+		authorized := false
+		// only services are authorized
+		if source, err := consul.ParseSpiffeID(cert.URIs[0]); err == nil {
+			sourceApp = source.Service
+			sourceNS = source.Namespace
+			authReq := AuthRequest{
+				Source:          source,
+				Target:          target,
+				TargetNamespace: targetNS,
+				// the requests of tcp frontends are not checked
+				HTTPChecked: m.Name != "check-intentions-tcp",
+			}
+			if isHTTP {
+				authReq.HTTP = req
+			}
+			authCacheAccess.WithLabelValues("hit").Inc()
+			authorized, err = h.authz.Authorize(authReq)
+			if err != nil {
+				log.Errorf("spoe handler: error authorizing %s to %s: %s", source, target, err)
+				authorized = false
+			}
 		}
 
+		e := AuditEntry{
+			Time:       time.Now(),
+			SourceID:   cert.URIs[0].String(),
+			CertSerial: cert.SerialNumber.String(),
+			Target:     target,
+			CertCached: cached,
+		}
+		if sourceIP != nil {
+			e.SourceIP = sourceIP.String()
+		}
+		if isHTTP {
+			e.Method = req.Method
+			e.Path = req.Path
+		}
+		h.record(e, sourceApp, authorized)
+
 		res := 1
 		if !authorized {
 			res = 0
 		}
+
+		if isHTTP {
+			return []spoe.Action{
+				spoe.ActionSetVar{
+					Name:  "http_auth",
+					Scope: spoe.VarScopeTransaction,
+					Value: res,
+				},
+			}, nil
+		}
+
 		return []spoe.Action{
 			spoe.ActionSetVar{
 				Name:  "auth",
@@ -128,81 +198,86 @@ func (h *SPOEHandler) Handler(msgs *spoe.MessageIterator) ([]spoe.Action, error)
 				Scope: spoe.VarScopeSession,
 				Value: sourceApp,
 			},
+			spoe.ActionSetVar{
+				Name:  "source_ns",
+				Scope: spoe.VarScopeSession,
+				Value: sourceNS,
+			},
 		}, nil
 	}
 	return nil, nil
 }
 
-func (h *SPOEHandler) isAuthorized(target, uri string, serial []byte) (bool, error) {
-	h.authCacheLock.Lock()
-	entry, ok := h.authCache[uri]
-	now := time.Now()
-	if !ok || now.Sub(entry.At) > cacheTTL {
-		authCacheAccess.WithLabelValues("miss").Inc()
-		entry = &cacheEntry{
-			At: now,
-			C:  make(chan struct{}),
+// target returns the service, and its namespace, a request is destined to
+// from the certificate of the frontend, which standalone agents rely on, or
+// from its name
+func (h *SPOEHandler) target(cfg consul.Config, frontend string, certBytes []byte) (string, string, error) {
+	if certBytes != nil {
+		cert, _, err := h.decodeCertificate(certBytes)
+		if err != nil {
+			return "", "", err
 		}
-		h.authCache[uri] = entry
-		h.authCacheLock.Unlock()
+		if len(cert.URIs) > 0 {
+			id, err := consul.ParseSpiffeID(cert.URIs[0])
+			if err != nil {
+				return "", "", err
+			}
+			return id.Service, id.Namespace, nil
+		}
+	}
 
-		go func() {
-			auth, err := h.fetchAutz(target, uri, serial)
+	return intentionsTarget(cfg, frontend)
+}
 
-			h.authCacheLock.Lock()
-			defer h.authCacheLock.Unlock()
+// intentionsTarget returns the service, and its namespace, the connections
+// accepted by frontend are destined to
+func intentionsTarget(cfg consul.Config, frontend string) (string, string, error) {
+	if cfg.Gateway != consul.GatewayTerminating {
+		return cfg.ServiceName, cfg.Namespace, nil
+	}
 
-			if err != nil {
-				log.Error(err)
-				entry.Value = false
-				// force refech on next request
-				entry.At = time.Time{}
-			} else {
-				entry.Value = auth
-			}
+	for _, s := range cfg.TerminatingServices {
+		if state.TerminatingFrontendName(s.Namespace, s.Name) == frontend {
+			return s.Name, s.Namespace, nil
+		}
+	}
+
+	return "", "", fmt.Errorf("no terminated service for frontend %s", frontend)
+}
 
-			// notify waiting requets
-			close(entry.C)
-		}()
+// record counts the decision and writes it to the audit log
+func (h *SPOEHandler) record(e AuditEntry, source string, authorized bool) {
+	if authorized {
+		e.Decision = "allow"
+		connectionsAllowed.WithLabelValues(source).Inc()
 	} else {
-		authCacheAccess.WithLabelValues("hit").Inc()
-		h.authCacheLock.Unlock()
+		e.Decision = "deny"
+		connectionsDenied.WithLabelValues(source).Inc()
 	}
 
-	select {
-	case <-time.After(authzTimeout):
-		return false, fmt.Errorf("authz call failed: timeout after %s", authzTimeout)
-	case <-entry.C:
-		return entry.Value, nil
+	if h.audit == nil {
+		return
 	}
-}
 
-func (h *SPOEHandler) fetchAutz(target, uri string, serial []byte) (bool, error) {
-	resp, err := h.c.Agent().ConnectAuthorize(&api.AgentAuthorizeParams{
-		Target:           target,
-		ClientCertURI:    uri,
-		ClientCertSerial: connect.HexString(serial),
-	})
+	err := h.audit.Log(e)
 	if err != nil {
-		return false, errors.Wrap(err, "authz call failed")
+		log.Errorf("spoe handler: error writing audit log: %s", err)
 	}
-
-	return resp.Authorized, nil
 }
 
-func (h *SPOEHandler) decodeCertificate(b []byte) (*x509.Certificate, error) {
+func (h *SPOEHandler) decodeCertificate(b []byte) (*x509.Certificate, bool, error) {
 	certCacheKey := string(b)
 	if v, ok := h.certCache.Get(certCacheKey); ok {
 		certCacheAccess.WithLabelValues("hit").Inc()
-		return v.(*x509.Certificate), nil
+		return v.(*x509.Certificate), true, nil
 	}
 
 	certCacheAccess.WithLabelValues("miss").Inc()
 	cert, err := x509.ParseCertificate(b)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	h.certCache.Set(certCacheKey, cert)
 
-	return cert, nil
+	return cert, false, nil
 }
@@ -0,0 +1,183 @@
+package haproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+
+	spoe "github.com/criteo/haproxy-spoe-go"
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/haproxy-consul-connect/lib"
+	log "github.com/sirupsen/logrus"
+)
+
+// SPOEAgentOptions configures a standalone SPOE intentions agent shared by
+// several HAProxy instances
+type SPOEAgentOptions struct {
+	// ListenAddr is a host:port or a unix@ socket path
+	ListenAddr string
+	// TLSCertFile and TLSKeyFile enable TLS, TLSCAFile the verification of
+	// the HAProxy client certificates
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSCAFile       string
+	AuthzPolicyFile string
+	AuditLog        string
+	AuditLogMaxSize int64
+}
+
+// SPOEAgent serves the intentions of all services to HAProxy instances
+type SPOEAgent struct {
+	opts SPOEAgentOptions
+	cfgC chan consul.Config
+
+	lock sync.Mutex
+	cfg  consul.Config
+}
+
+func NewSPOEAgent(cfgC chan consul.Config, opts SPOEAgentOptions) *SPOEAgent {
+	return &SPOEAgent{
+		opts: opts,
+		cfgC: cfgC,
+	}
+}
+
+func (a *SPOEAgent) Run(sd *lib.Shutdown) error {
+	select {
+	case <-sd.Stop:
+		return nil
+	case a.cfg = <-a.cfgC:
+	}
+
+	go func() {
+		for {
+			select {
+			case <-sd.Stop:
+				return
+			case cfg := <-a.cfgC:
+				a.lock.Lock()
+				a.cfg = cfg
+				a.lock.Unlock()
+			}
+		}
+	}()
+
+	cfg := func() consul.Config {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		return a.cfg
+	}
+
+	tlsConfig, err := spoeTLSConfig(a.opts)
+	if err != nil {
+		return err
+	}
+	lis, err := listenSPOE(a.opts.ListenAddr, tlsConfig)
+	if err != nil {
+		return err
+	}
+	log.Infof("spoe agent listening on %s", a.opts.ListenAddr)
+
+	handler, err := newSPOEHandler(sd, cfg, a.opts.AuthzPolicyFile, a.opts.AuditLog, a.opts.AuditLogMaxSize)
+	if err != nil {
+		lis.Close()
+		return err
+	}
+
+	return serveSPOE(sd, lis, handler)
+}
+
+// newSPOEHandler returns a handler authorizing requests with the intentions
+// and the static policy file when set
+func newSPOEHandler(sd *lib.Shutdown, cfg func() consul.Config, policyFile, auditLog string, auditLogMaxSize int64) (*SPOEHandler, error) {
+	var authz Authorizer = NewIntentionsAuthorizer(cfg)
+	if policyFile != "" {
+		static, err := NewStaticAuthorizer(policyFile, sd)
+		if err != nil {
+			return nil, err
+		}
+		authz = ChainAuthorizer{authz, static}
+	}
+
+	var audit *AuditLog
+	if auditLog != "" {
+		var err error
+		audit, err = NewAuditLog(auditLog, auditLogMaxSize)
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			<-sd.Stop
+			audit.Close()
+		}()
+	}
+
+	return NewSPOEHandler(cfg, authz, audit), nil
+}
+
+// listenSPOE listens on a unix@ socket path or a TCP address
+func listenSPOE(addr string, tlsConfig *tls.Config) (net.Listener, error) {
+	var lis net.Listener
+	var err error
+	if strings.HasPrefix(addr, "unix@") {
+		lis, err = net.Listen("unix", strings.TrimPrefix(addr, "unix@"))
+	} else {
+		lis, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error starting spoe agent: %s", err)
+	}
+	if tlsConfig != nil {
+		lis = tls.NewListener(lis, tlsConfig)
+	}
+	return lis, nil
+}
+
+// serveSPOE serves handler on lis until shutdown
+func serveSPOE(sd *lib.Shutdown, lis net.Listener, handler *SPOEHandler) error {
+	go func() {
+		<-sd.Stop
+		lis.Close()
+	}()
+
+	err := spoe.New(handler.Handler).Serve(lis)
+	select {
+	case <-sd.Stop:
+		return nil
+	default:
+		return fmt.Errorf("spoe agent: %s", err)
+	}
+}
+
+func spoeTLSConfig(opts SPOEAgentOptions) (*tls.Config, error) {
+	if opts.TLSCertFile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(opts.TLSCertFile, opts.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if opts.TLSCAFile != "" {
+		ca, err := ioutil.ReadFile(opts.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in %s", opts.TLSCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, nil
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/haproxytech/haproxy-consul-connect/consul"
 	"github.com/haproxytech/haproxy-consul-connect/haproxy/state"
+	"github.com/haproxytech/haproxy-consul-connect/haproxy/stats"
 	"github.com/haproxytech/haproxy-consul-connect/lib"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/d4l3k/messagediff.v1"
@@ -52,6 +53,7 @@ func (h *HAProxy) watch(sd *lib.Shutdown) error {
 				log.Info("handling new configuration")
 				h.currentConsulConfig = &c
 				currentConfig = c
+				stats.SetUpstreamDatacenters(c)
 				inputReceived = true
 			case <-resyncConfig:
 				log.Info("periodic haproxy config sync check")
@@ -93,6 +95,10 @@ func (h *HAProxy) watch(sd *lib.Shutdown) error {
 			LogSocket:        h.haConfig.LogsSock,
 			SPOEConfigPath:   h.haConfig.SPOE,
 			SPOESocket:       h.haConfig.SPOESock,
+			SPOEAddress:      h.opts.SPOEAddress,
+			SPOECAFile:       h.opts.SPOECAFile,
+			SPOECertFile:     h.opts.SPOECertFile,
+			SocketDir:        h.haConfig.Base,
 		}, h.haConfig, currentState, currentConfig)
 		if err != nil {
 			log.Error(err)
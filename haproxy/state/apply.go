@@ -81,6 +81,27 @@ func applyFrontends(ha HAProxy, old, new []Frontend) error {
 				return err
 			}
 		}
+
+		for _, r := range newUp.TCPRequestRules {
+			err = ha.CreateTCPRequestRule("frontend", newUp.Frontend.Name, r)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, r := range newUp.HTTPRequestRules {
+			err = ha.CreateHTTPRequestRule("frontend", newUp.Frontend.Name, r)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, r := range newUp.BackendSwitchingRules {
+			err = ha.CreateBackendSwitchingRule(newUp.Frontend.Name, r)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
@@ -55,20 +55,17 @@ func generateDownstream(opts Options, certStore CertificateStore, cfg consul.Dow
 
 	// Intentions
 	if opts.EnableIntentions {
-		fe.Filter = &FrontendFilter{
-			Filter: models.Filter{
+		fe.Filter = intentionsFilter(opts, feMode)
+
+		// L7 intentions are checked on each request
+		if feMode == models.FrontendModeHTTP {
+			fe.HTTPRequestRules = append(fe.HTTPRequestRules, models.HTTPRequestRule{
 				Index:      int64p(0),
-				Type:       models.FilterTypeSpoe,
-				SpoeEngine: "intentions",
-				SpoeConfig: opts.SPOEConfigPath,
-			},
-			Rule: models.TCPRequestRule{
-				Index:    int64p(0),
-				Action:   models.TCPRequestRuleActionReject,
-				Cond:     models.TCPRequestRuleCondUnless,
-				CondTest: "{ var(sess.connect.auth) -m int eq 1 }",
-				Type:     models.TCPRequestRuleTypeContent,
-			},
+				Type:       models.HTTPRequestRuleTypeDeny,
+				DenyStatus: 403,
+				Cond:       models.HTTPRequestRuleCondUnless,
+				CondTest:   "{ var(txn.connect.http_auth) -m int eq 1 }",
+			})
 		}
 	}
 
@@ -118,8 +115,41 @@ func generateDownstream(opts Options, certStore CertificateStore, cfg consul.Dow
 			HdrFormat: "%[var(sess.connect.source_app)]",
 		})
 	}
+	if cfg.AppNSHeaderName != "" && beMode == models.BackendModeHTTP {
+		be.HTTPRequestRules = append(be.HTTPRequestRules, models.HTTPRequestRule{
+			Index:     int64p(len(be.HTTPRequestRules)),
+			Type:      models.HTTPRequestRuleTypeAddHeader,
+			HdrName:   cfg.AppNSHeaderName,
+			HdrFormat: "%[var(sess.connect.source_ns)]",
+		})
+	}
 
 	state.Backends = append(state.Backends, be)
 
 	return state, nil
 }
+
+// intentionsFilter rejects the connections not authorized by the SPOE agent.
+// The requests of http frontends are checked as well, so the agent lets
+// their connections through when only their requests may be denied.
+func intentionsFilter(opts Options, mode string) *FrontendFilter {
+	engine := "intentions"
+	if mode == models.FrontendModeTCP {
+		engine = "intentions-tcp"
+	}
+	return &FrontendFilter{
+		Filter: models.Filter{
+			Index:      int64p(0),
+			Type:       models.FilterTypeSpoe,
+			SpoeEngine: engine,
+			SpoeConfig: opts.SPOEConfigPath,
+		},
+		Rule: models.TCPRequestRule{
+			Index:    int64p(0),
+			Action:   models.TCPRequestRuleActionReject,
+			Cond:     models.TCPRequestRuleCondUnless,
+			CondTest: "{ var(sess.connect.auth) -m int eq 1 }",
+			Type:     models.TCPRequestRuleTypeContent,
+		},
+	}
+}
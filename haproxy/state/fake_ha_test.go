@@ -22,6 +22,7 @@ const (
 	haOpCreateTCPRequestRule
 	haOpCreateLogTargets
 	haOpCreateHTTPRequestRule
+	haOpCreateBackendSwitchingRule
 )
 
 type fakeHAOp struct {
@@ -145,3 +146,11 @@ func (h *fakeHA) CreateHTTPRequestRule(parentType, parentName string, rule model
 	})
 	return nil
 }
+
+func (h *fakeHA) CreateBackendSwitchingRule(feName string, rule models.BackendSwitchingRule) error {
+	h.ops = append(h.ops, fakeHAOp{
+		Type: haOpCreateBackendSwitchingRule,
+		Name: feName,
+	})
+	return nil
+}
@@ -14,6 +14,7 @@ type HAProxyRead interface {
 	Filters(parentType, parentName string) ([]models.Filter, error)
 	TCPRequestRules(parentType, parentName string) ([]models.TCPRequestRule, error)
 	HTTPRequestRules(parentType, parentName string) ([]models.HTTPRequestRule, error)
+	BackendSwitchingRules(feName string) ([]models.BackendSwitchingRule, error)
 	Backends() ([]models.Backend, error)
 	Servers(beName string) ([]models.Server, error)
 }
@@ -54,27 +55,52 @@ func FromHAProxy(ha HAProxyRead) (State, error) {
 		if len(logTargets) > 1 {
 			return state, fmt.Errorf("expected at most 1 filter for frontend %s, got %d", f.Name, len(filters))
 		}
+		tcpRules, err := ha.TCPRequestRules("frontend", f.Name)
+		if err != nil {
+			return state, err
+		}
+
 		var filter *FrontendFilter
 		if len(filters) == 1 {
 			filter = &FrontendFilter{
 				Filter: filters[0],
 			}
 
-			rules, err := ha.TCPRequestRules("frontend", f.Name)
-			if err != nil {
-				return state, err
-			}
-			if len(binds) != 1 {
-				return state, fmt.Errorf("expected 1 tcp request rule for frontend %s, got %d", f.Name, len(rules))
+			// the filter rule is always the first one
+			if len(tcpRules) == 0 {
+				return state, fmt.Errorf("expected a tcp request rule for the filter of frontend %s", f.Name)
 			}
-			filter.Rule = rules[0]
+			filter.Rule = tcpRules[0]
+			tcpRules = tcpRules[1:]
+		}
+		if len(tcpRules) == 0 {
+			tcpRules = nil
+		}
+
+		reqRules, err := ha.HTTPRequestRules("frontend", f.Name)
+		if err != nil {
+			return state, err
+		}
+		if len(reqRules) == 0 {
+			reqRules = nil
+		}
+
+		switchingRules, err := ha.BackendSwitchingRules(f.Name)
+		if err != nil {
+			return state, err
+		}
+		if len(switchingRules) == 0 {
+			switchingRules = nil
 		}
 
 		state.Frontends = append(state.Frontends, Frontend{
-			Frontend:  f,
-			Bind:      binds[0],
-			LogTarget: lt,
-			Filter:    filter,
+			Frontend:              f,
+			Bind:                  binds[0],
+			LogTarget:             lt,
+			Filter:                filter,
+			TCPRequestRules:       tcpRules,
+			HTTPRequestRules:      reqRules,
+			BackendSwitchingRules: switchingRules,
 		})
 	}
 
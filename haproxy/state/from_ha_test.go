@@ -88,7 +88,7 @@ RHmDi0qnL6qrKfjTOnfHgQPCgxAy9knMIiDzBRg=
 	[intentions]
 
 	spoe-agent intentions-agent
-		messages check-intentions
+		messages check-intentions check-intentions-http
 
 		option var-prefix connect
 
@@ -99,8 +99,12 @@ RHmDi0qnL6qrKfjTOnfHgQPCgxAy9knMIiDzBRg=
 		use-backend spoe_back
 
 	spoe-message check-intentions
-		args ip=src cert=ssl_c_der
+		args ip=src cert=ssl_c_der target=ssl_f_der frontend=fe_name
 		event on-frontend-tcp-request
+
+	spoe-message check-intentions-http
+		args ip=src cert=ssl_c_der target=ssl_f_der frontend=fe_name method=method path=path headers=req.hdrs_bin
+		event on-frontend-http-request
 	`), 0644)
 	require.NoError(t, err)
 
@@ -140,3 +144,12 @@ func TestFromHA(t *testing.T) {
 	state := GetTestHAConfig(cfgDir, "")
 	testCfg(t, cfgDir, state)
 }
+
+func TestFromHAOutlierDetection(t *testing.T) {
+	cfgDir, err := ioutil.TempDir("", fmt.Sprintf("%s_*", t.Name()))
+	require.NoError(t, err)
+
+	state := GetTestHAConfig(cfgDir, "")
+	withOutlierDetection(state.Backends[1].Servers)
+	testCfg(t, cfgDir, state)
+}
@@ -0,0 +1,98 @@
+package state
+
+import (
+	"fmt"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/models/v2"
+)
+
+const (
+	meshFrontend    = "front_mesh"
+	sniInspectDelay = 5000
+)
+
+// generateMeshGateway routes the incoming connections on their SNI, without
+// terminating TLS, to local services or to remote datacenters mesh gateways
+func generateMeshGateway(opts Options, cfg consul.Config, oldState, newState State) (State, error) {
+	router := sniRouterFrontend(meshFrontend, cfg.Downstream)
+	if opts.LogRequests && opts.LogSocket != "" {
+		router.LogTarget = &models.LogTarget{
+			Index:    int64p(0),
+			Address:  opts.LogSocket,
+			Facility: models.LogTargetFacilityLocal0,
+			Format:   models.LogTargetFormatRfc5424,
+		}
+	}
+
+	for _, r := range cfg.MeshGatewayRoutes {
+		beName := fmt.Sprintf("back_mesh_%s_%s", r.Namespace, r.Name)
+		cond := fmt.Sprintf("{ req.ssl_sni -m str %s }", r.SNI)
+		if r.Remote {
+			beName = fmt.Sprintf("back_mesh_dc_%s", r.Name)
+			cond = fmt.Sprintf("{ req.ssl_sni -m end %s }", r.SNI)
+		}
+
+		router.BackendSwitchingRules = append(router.BackendSwitchingRules, models.BackendSwitchingRule{
+			Index:    int64p(len(router.BackendSwitchingRules)),
+			Name:     beName,
+			Cond:     models.BackendSwitchingRuleCondIf,
+			CondTest: cond,
+		})
+
+		be := Backend{
+			Backend: models.Backend{
+				Name:           beName,
+				ConnectTimeout: int64p(int(r.ConnectTimeout.Milliseconds())),
+				Balance: &models.Balance{
+					Algorithm: stringp(models.BalanceAlgorithmLeastconn),
+				},
+				Mode: models.BackendModeTCP,
+			},
+			Servers: generateServers(models.Server{}, r.Nodes, beName, oldState),
+		}
+		if opts.LogRequests && opts.LogSocket != "" {
+			be.LogTarget = &models.LogTarget{
+				Index:    int64p(0),
+				Address:  opts.LogSocket,
+				Facility: models.LogTargetFacilityLocal0,
+				Format:   models.LogTargetFormatRfc5424,
+			}
+		}
+		newState.Backends = append(newState.Backends, be)
+	}
+
+	newState.Frontends = append(newState.Frontends, router)
+
+	return newState, nil
+}
+
+// sniRouterFrontend builds a tcp frontend listening on the downstream
+// address, waiting for the TLS client hello to route on its SNI
+func sniRouterFrontend(name string, cfg consul.Downstream) Frontend {
+	return Frontend{
+		Frontend: models.Frontend{
+			Name: name,
+			Mode: models.FrontendModeTCP,
+		},
+		Bind: models.Bind{
+			Name:    fmt.Sprintf("%s_bind", name),
+			Address: cfg.LocalBindAddress,
+			Port:    int64p(cfg.LocalBindPort),
+		},
+		TCPRequestRules: []models.TCPRequestRule{
+			{
+				Index:   int64p(0),
+				Type:    models.TCPRequestRuleTypeInspectDelay,
+				Timeout: int64p(sniInspectDelay),
+			},
+			{
+				Index:    int64p(1),
+				Type:     models.TCPRequestRuleTypeContent,
+				Action:   models.TCPRequestRuleActionAccept,
+				Cond:     models.TCPRequestRuleCondIf,
+				CondTest: "{ req.ssl_hello_type 1 }",
+			},
+		},
+	}
+}
@@ -4,9 +4,11 @@ import (
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/haproxytech/haproxy-consul-connect/consul"
 	"github.com/haproxytech/models/v2"
+	"github.com/hashicorp/consul/agent/connect"
 	"github.com/stretchr/testify/require"
 )
 
@@ -88,6 +90,15 @@ func GetTestHAConfig(baseCfg string, certVersion string) State {
 						Type:     models.TCPRequestRuleTypeContent,
 					},
 				},
+				HTTPRequestRules: []models.HTTPRequestRule{
+					{
+						Index:      int64p(0),
+						Type:       models.HTTPRequestRuleTypeDeny,
+						DenyStatus: 403,
+						Cond:       models.HTTPRequestRuleCondUnless,
+						CondTest:   "{ var(txn.connect.http_auth) -m int eq 1 }",
+					},
+				},
 			},
 
 			// upstream front
@@ -234,6 +245,24 @@ func TestSnapshotDownstream(t *testing.T) {
 	require.Equal(t, GetTestHAConfig("/", ""), generated)
 }
 
+func TestSnapshotSPOEAddress(t *testing.T) {
+	opts := TestOpts
+	opts.SPOEAddress = "10.0.0.1:9101"
+
+	generated, err := Generate(opts, TestCertStore, State{}, GetTestConsulConfig())
+	require.Nil(t, err)
+
+	// the server reads back like it is generated
+	expected := GetTestHAConfig("/", "")
+	expected.Backends[2].Servers[0].Address = "10.0.0.1"
+	expected.Backends[2].Servers[0].Port = int64p(9101)
+	require.Equal(t, expected, generated)
+
+	opts.SPOEAddress = "10.0.0.1"
+	_, err = Generate(opts, TestCertStore, State{}, GetTestConsulConfig())
+	require.Error(t, err)
+}
+
 func TestServerUpdate(t *testing.T) {
 	consulCfg := GetTestConsulConfig()
 	consulCfg.Upstreams[0].Nodes = consulCfg.Upstreams[0].Nodes[1:]
@@ -314,3 +343,492 @@ type fakeCertStore struct {
 func (s fakeCertStore) CertsPath(t consul.TLS) (string, string, error) {
 	return "//ca" + s.suffix, "//cert" + s.suffix, nil
 }
+
+func TestSnapshotUpstreamRoutes(t *testing.T) {
+	cfg := GetTestConsulConfig()
+	cfg.Upstreams[0].Nodes = nil
+	cfg.Upstreams[0].Targets = []consul.UpstreamTarget{
+		{
+			Name:  "v1.service_1.default.dc1",
+			Nodes: []consul.UpstreamNode{{Host: "1.2.3.4", Port: 8080, Weight: 1}},
+		},
+		{
+			Name:           "v2.service_1.default.dc1",
+			ConnectTimeout: time.Second,
+			Nodes:          []consul.UpstreamNode{{Host: "1.2.3.5", Port: 8080, Weight: 1}},
+		},
+	}
+	cfg.Upstreams[0].Routes = []consul.UpstreamRoute{
+		{
+			Match: consul.UpstreamRouteMatch{
+				PathPrefix: "/admin",
+				Headers: []consul.UpstreamHeaderMatch{
+					{Name: "X-Debug", Present: true, Invert: true},
+				},
+			},
+			Splits: []consul.UpstreamSplit{
+				{Weight: 100, Target: "v2.service_1.default.dc1"},
+			},
+		},
+		{
+			Splits: []consul.UpstreamSplit{
+				{Weight: 25, Target: "v2.service_1.default.dc1"},
+				{Weight: 75, Target: "v1.service_1.default.dc1"},
+			},
+		},
+	}
+
+	generated, err := Generate(TestOpts, TestCertStore, State{}, cfg)
+	require.Nil(t, err)
+
+	var fe Frontend
+	for _, f := range generated.Frontends {
+		if f.Frontend.Name == "front_service_1" {
+			fe = f
+		}
+	}
+
+	require.Equal(t, "back_service_1_v1.service_1.default.dc1", fe.Frontend.DefaultBackend)
+	require.Equal(t, []models.HTTPRequestRule{
+		{
+			Index:    int64p(0),
+			Type:     models.HTTPRequestRuleTypeSetVar,
+			VarScope: "txn",
+			VarName:  "connect.split",
+			VarExpr:  "rand(10000)",
+		},
+	}, fe.HTTPRequestRules)
+	require.Equal(t, []models.BackendSwitchingRule{
+		{
+			Index:    int64p(0),
+			Name:     "back_service_1_v2.service_1.default.dc1",
+			Cond:     models.BackendSwitchingRuleCondIf,
+			CondTest: "{ path_beg /admin } !{ req.hdr(X-Debug) -m found }",
+		},
+		{
+			Index:    int64p(1),
+			Name:     "back_service_1_v2.service_1.default.dc1",
+			Cond:     models.BackendSwitchingRuleCondIf,
+			CondTest: "{ var(txn.connect.split) -m int lt 2500 }",
+		},
+	}, fe.BackendSwitchingRules)
+
+	backends := map[string]Backend{}
+	for _, b := range generated.Backends {
+		backends[b.Backend.Name] = b
+	}
+	require.NotContains(t, backends, "back_service_1")
+	require.Contains(t, backends, "back_service_1_v1.service_1.default.dc1")
+	require.Equal(t, int64p(1000), backends["back_service_1_v2.service_1.default.dc1"].Backend.ConnectTimeout)
+	require.Equal(t, "1.2.3.5", backends["back_service_1_v2.service_1.default.dc1"].Servers[0].Address)
+}
+
+func TestUpstreamRoutesCatchAll(t *testing.T) {
+	backends := map[string]string{
+		"v1": "back_v1",
+		"v2": "back_v2",
+	}
+	admin := consul.UpstreamRoute{
+		Match:  consul.UpstreamRouteMatch{PathPrefix: "/admin"},
+		Splits: []consul.UpstreamSplit{{Weight: 100, Target: "v2"}},
+	}
+
+	// the catch-all route is used even when its last target is unknown
+	defaultBackend, rules, split, err := upstreamRoutes([]consul.UpstreamRoute{
+		admin,
+		{
+			Splits: []consul.UpstreamSplit{
+				{Weight: 50, Target: "v1"},
+				{Weight: 50, Target: "missing"},
+			},
+		},
+	}, backends)
+	require.NoError(t, err)
+	require.Equal(t, "back_v1", defaultBackend)
+	require.Len(t, rules, 1)
+	require.False(t, split)
+
+	// without a catch-all route, there is no default backend
+	defaultBackend, rules, _, err = upstreamRoutes([]consul.UpstreamRoute{admin}, backends)
+	require.NoError(t, err)
+	require.Equal(t, "", defaultBackend)
+	require.Len(t, rules, 1)
+}
+
+func TestRouteCondition(t *testing.T) {
+	for _, tc := range []struct {
+		match    consul.UpstreamRouteMatch
+		expected string
+	}{
+		{
+			match:    consul.UpstreamRouteMatch{PathExact: "/api/v1"},
+			expected: "{ path /api/v1 }",
+		},
+		{
+			match:    consul.UpstreamRouteMatch{PathExact: "/a b#c}"},
+			expected: "{ path '/a b#c}' }",
+		},
+		{
+			match:    consul.UpstreamRouteMatch{PathRegex: `/v[0-9]+/.*\.json`},
+			expected: `{ path_reg '/v[0-9]+/.*\.json' }`,
+		},
+		{
+			match:    consul.UpstreamRouteMatch{Hosts: []string{"web.example.com"}},
+			expected: `{ req.hdr(host),field(1,:) -m reg -i '^(web\.example\.com)$' }`,
+		},
+		{
+			match: consul.UpstreamRouteMatch{Headers: []consul.UpstreamHeaderMatch{
+				{Name: "X-User", Exact: "it's me"},
+				{Name: "X-Flag", Prefix: "-i", Invert: true},
+			}},
+			expected: `{ req.hdr(X-User) -m str 'it'\''s me' } !{ req.hdr(X-Flag) -m beg -- -i }`,
+		},
+	} {
+		cond, err := routeCondition(tc.match)
+		require.NoError(t, err)
+		require.Equal(t, tc.expected, cond)
+	}
+
+	for _, m := range []consul.UpstreamRouteMatch{
+		{PathPrefix: "}"},
+		{Headers: []consul.UpstreamHeaderMatch{{Name: "X-User)", Present: true}}},
+		{QueryParams: []consul.UpstreamQueryParamMatch{{Name: "a,b", Exact: "c"}}},
+	} {
+		_, err := routeCondition(m)
+		require.Error(t, err)
+	}
+}
+
+func TestSnapshotInvalidRoute(t *testing.T) {
+	cfg := GetTestConsulConfig()
+	cfg.Upstreams[0].Routes = []consul.UpstreamRoute{
+		{
+			Match:  consul.UpstreamRouteMatch{PathExact: "}"},
+			Splits: []consul.UpstreamSplit{{Weight: 100, Target: "missing"}},
+		},
+	}
+
+	_, err := Generate(TestOpts, TestCertStore, State{}, cfg)
+	require.Error(t, err)
+}
+
+func TestHostsRegex(t *testing.T) {
+	require.Equal(t, `^(web\.example\.com|[^.]+\.example\.com|api\.ingress\..*)$`, hostsRegex([]string{
+		"web.example.com",
+		"*.example.com",
+		"api.ingress.*",
+	}))
+	require.Equal(t, `^(.*)$`, hostsRegex([]string{"*"}))
+}
+
+func TestSnapshotTerminatingGateway(t *testing.T) {
+	cfg := consul.Config{
+		ServiceName: "terminating",
+		Gateway:     consul.GatewayTerminating,
+		Downstream: consul.Downstream{
+			LocalBindAddress: "0.0.0.0",
+			LocalBindPort:    8443,
+		},
+		TerminatingServices: []consul.TerminatingService{
+			{
+				Name:           "db",
+				Namespace:      "default",
+				SNI:            "db.default.dc1.internal.test.consul",
+				ConnectTimeout: consul.DefaultConnectTimeout,
+				ReadTimeout:    consul.DefaultReadTimeout,
+				ExternalTLS: &consul.ExternalTLS{
+					TLS: consul.TLS{CAs: [][]byte{[]byte("ca")}},
+					SNI: "db.example.com",
+				},
+				Nodes: []consul.UpstreamNode{{Host: "10.0.0.1", Port: 5432, Weight: 1}},
+			},
+			{
+				Name:           "db",
+				Namespace:      "billing",
+				SNI:            "db.billing.dc1.internal.test.consul",
+				ConnectTimeout: consul.DefaultConnectTimeout,
+				ReadTimeout:    consul.DefaultReadTimeout,
+				Nodes:          []consul.UpstreamNode{{Host: "10.0.0.2", Port: 5432, Weight: 1}},
+			},
+		},
+	}
+
+	opts := TestOpts
+	opts.SocketDir = "/sockets"
+
+	generated, err := Generate(opts, TestCertStore, State{}, cfg)
+	require.Nil(t, err)
+
+	frontends := map[string]Frontend{}
+	for _, f := range generated.Frontends {
+		frontends[f.Frontend.Name] = f
+	}
+	backends := map[string]Backend{}
+	for _, b := range generated.Backends {
+		backends[b.Backend.Name] = b
+	}
+
+	require.NotContains(t, frontends, "front_downstream")
+	require.Equal(t, []models.BackendSwitchingRule{
+		{
+			Index:    int64p(0),
+			Name:     "sni_terminating_default_db",
+			Cond:     models.BackendSwitchingRuleCondIf,
+			CondTest: "{ req.ssl_sni -m str db.default.dc1.internal.test.consul }",
+		},
+		{
+			Index:    int64p(1),
+			Name:     "sni_terminating_billing_db",
+			Cond:     models.BackendSwitchingRuleCondIf,
+			CondTest: "{ req.ssl_sni -m str db.billing.dc1.internal.test.consul }",
+		},
+	}, frontends["front_terminating"].BackendSwitchingRules)
+	require.Equal(t, "unix@/sockets/terminating_default_db.sock", backends["sni_terminating_default_db"].Servers[0].Address)
+	require.Equal(t, "unix@/sockets/terminating_billing_db.sock", backends["sni_terminating_billing_db"].Servers[0].Address)
+
+	fe := frontends[TerminatingFrontendName("default", "db")]
+	require.Equal(t, "unix@/sockets/terminating_default_db.sock", fe.Bind.Address)
+	require.True(t, fe.Bind.Ssl)
+	require.NotNil(t, fe.Filter)
+	// L7 intentions cannot be checked, they deny the connections
+	require.Equal(t, "intentions-tcp", fe.Filter.Filter.SpoeEngine)
+	require.Equal(t, "back_terminating_default_db", fe.Frontend.DefaultBackend)
+
+	srv := backends["back_terminating_default_db"].Servers[0]
+	require.Equal(t, "10.0.0.1", srv.Address)
+	require.Equal(t, models.ServerSslEnabled, srv.Ssl)
+	require.Equal(t, models.BindVerifyRequired, srv.Verify)
+	require.Equal(t, "str(db.example.com)", srv.Sni)
+
+	// the service with the same name in another namespace gets its own
+	// frontend and backend
+	fe = frontends[TerminatingFrontendName("billing", "db")]
+	require.Equal(t, "unix@/sockets/terminating_billing_db.sock", fe.Bind.Address)
+	require.Equal(t, "back_terminating_billing_db", fe.Frontend.DefaultBackend)
+	require.Equal(t, "10.0.0.2", backends["back_terminating_billing_db"].Servers[0].Address)
+}
+
+func TestSnapshotMeshGateway(t *testing.T) {
+	cfg := consul.Config{
+		ServiceName: "mesh-gateway",
+		Gateway:     consul.GatewayMesh,
+		Downstream: consul.Downstream{
+			LocalBindAddress: "0.0.0.0",
+			LocalBindPort:    8443,
+		},
+		MeshGatewayRoutes: []consul.MeshGatewayRoute{
+			{
+				Name:           "web",
+				Namespace:      "default",
+				SNI:            "web.default.dc1.internal.test.consul",
+				ConnectTimeout: consul.DefaultConnectTimeout,
+				Nodes:          []consul.UpstreamNode{{Host: "10.0.0.1", Port: 21000, Weight: 1}},
+			},
+			{
+				Name:           "web",
+				Namespace:      "billing",
+				SNI:            "web.billing.dc1.internal.test.consul",
+				ConnectTimeout: consul.DefaultConnectTimeout,
+				Nodes:          []consul.UpstreamNode{{Host: "10.0.0.2", Port: 21000, Weight: 1}},
+			},
+			{
+				Name:           "dc2",
+				SNI:            ".dc2.internal.test.consul",
+				Remote:         true,
+				ConnectTimeout: consul.DefaultConnectTimeout,
+				Nodes:          []consul.UpstreamNode{{Host: "192.168.0.1", Port: 8443, Weight: 1}},
+			},
+		},
+	}
+
+	generated, err := Generate(TestOpts, TestCertStore, State{}, cfg)
+	require.Nil(t, err)
+
+	require.Len(t, generated.Frontends, 1)
+	fe := generated.Frontends[0]
+	require.Equal(t, "front_mesh", fe.Frontend.Name)
+	require.Nil(t, fe.Filter)
+	require.Equal(t, models.TCPRequestRuleTypeInspectDelay, fe.TCPRequestRules[0].Type)
+	require.Equal(t, []models.BackendSwitchingRule{
+		{
+			Index:    int64p(0),
+			Name:     "back_mesh_default_web",
+			Cond:     models.BackendSwitchingRuleCondIf,
+			CondTest: "{ req.ssl_sni -m str web.default.dc1.internal.test.consul }",
+		},
+		{
+			Index:    int64p(1),
+			Name:     "back_mesh_billing_web",
+			Cond:     models.BackendSwitchingRuleCondIf,
+			CondTest: "{ req.ssl_sni -m str web.billing.dc1.internal.test.consul }",
+		},
+		{
+			Index:    int64p(2),
+			Name:     "back_mesh_dc_dc2",
+			Cond:     models.BackendSwitchingRuleCondIf,
+			CondTest: "{ req.ssl_sni -m end .dc2.internal.test.consul }",
+		},
+	}, fe.BackendSwitchingRules)
+
+	backends := map[string]Backend{}
+	for _, b := range generated.Backends {
+		backends[b.Backend.Name] = b
+	}
+	require.Equal(t, models.BackendModeTCP, backends["back_mesh_dc_dc2"].Backend.Mode)
+	require.Equal(t, "192.168.0.1", backends["back_mesh_dc_dc2"].Servers[0].Address)
+	require.Empty(t, backends["back_mesh_default_web"].Servers[0].Ssl)
+	require.Equal(t, "10.0.0.2", backends["back_mesh_billing_web"].Servers[0].Address)
+}
+
+func TestSnapshotUpstreamIdentity(t *testing.T) {
+	cfg := GetTestConsulConfig()
+	cfg.Upstreams[0].SNI = "service_1.default.dc2.internal.test.consul"
+	cfg.Upstreams[0].SpiffeID = "spiffe://test.consul/ns/default/dc/dc2/svc/service_1"
+
+	generated, err := Generate(TestOpts, TestCertStore, State{}, cfg)
+	require.Nil(t, err)
+
+	for _, b := range generated.Backends {
+		if b.Backend.Name != "back_service_1" {
+			continue
+		}
+		for _, s := range b.Servers {
+			require.Equal(t, "str(service_1.default.dc2.internal.test.consul)", s.Sni)
+			require.Equal(t, connect.ServiceCN("service_1", "default", "test.consul"), s.Verifyhost)
+		}
+		return
+	}
+	t.Fatal("back_service_1 not found")
+}
+
+func TestSnapshotFailoverIdentity(t *testing.T) {
+	cfg := GetTestConsulConfig()
+	cfg.Upstreams[0].SNI = "service_1.default.dc1.internal.test.consul"
+	cfg.Upstreams[0].SpiffeID = "spiffe://test.consul/ns/default/dc/dc1/svc/service_1"
+	cfg.Upstreams[0].Nodes[1].Backup = true
+	cfg.Upstreams[0].Nodes[1].SNI = "service_2.default.dc2.internal.test.consul"
+	cfg.Upstreams[0].Nodes[1].SpiffeID = "spiffe://test.consul/ns/default/dc/dc2/svc/service_2"
+
+	generated, err := Generate(TestOpts, TestCertStore, State{}, cfg)
+	require.Nil(t, err)
+
+	servers := generated.Backends[1].Servers
+	require.Equal(t, "str(service_1.default.dc1.internal.test.consul)", servers[0].Sni)
+	require.Equal(t, connect.ServiceCN("service_1", "default", "test.consul"), servers[0].Verifyhost)
+	require.Equal(t, "str(service_2.default.dc2.internal.test.consul)", servers[1].Sni)
+	require.Equal(t, connect.ServiceCN("service_2", "default", "test.consul"), servers[1].Verifyhost)
+}
+
+func TestSnapshotBackupServers(t *testing.T) {
+	cfg := GetTestConsulConfig()
+	cfg.Upstreams[0].Nodes[1].Backup = true
+
+	generated, err := Generate(TestOpts, TestCertStore, State{}, cfg)
+	require.Nil(t, err)
+
+	expected := GetTestHAConfig("/", "")
+	expected.Backends[1].Backend.Allbackups = models.BackendAllbackupsEnabled
+	expected.Backends[1].Servers[1].Backup = models.ServerBackupEnabled
+	require.Equal(t, expected, generated)
+
+	// the backend stops using all the backups with the last one leaving
+	generated, err = Generate(TestOpts, TestCertStore, generated, GetTestConsulConfig())
+	require.Nil(t, err)
+	require.Equal(t, GetTestHAConfig("/", ""), generated)
+}
+
+func TestSnapshotServerWeight(t *testing.T) {
+	generated, err := Generate(TestOpts, TestCertStore, State{}, GetTestConsulConfig())
+	require.Nil(t, err)
+
+	// weights changing with the round trip times or the health of instances
+	// are updated in place
+	cfg := GetTestConsulConfig()
+	cfg.Upstreams[0].Nodes[1].Weight = 3
+	generated, err = Generate(TestOpts, TestCertStore, generated, cfg)
+	require.Nil(t, err)
+
+	expected := GetTestHAConfig("/", "")
+	expected.Backends[1].Servers[1].Weight = int64p(3)
+	require.Equal(t, expected, generated)
+}
+
+func TestSnapshotUpstreamBalance(t *testing.T) {
+	cfg := GetTestConsulConfig()
+	cfg.Upstreams[0].Balance = consul.UpstreamBalance{
+		Algorithm: consul.BalanceHdr,
+		HdrName:   "X-User",
+	}
+
+	generated, err := Generate(TestOpts, TestCertStore, State{}, cfg)
+	require.Nil(t, err)
+
+	expected := GetTestHAConfig("/", "")
+	expected.Backends[1].Backend.Balance = &models.Balance{
+		Algorithm: stringp(consul.BalanceHdr),
+		HdrName:   "X-User",
+	}
+	expected.Backends[1].Backend.HashType = &models.BackendHashType{
+		Method: models.BackendHashTypeMethodConsistent,
+	}
+	require.Equal(t, expected, generated)
+
+	// changing the algorithm recreates the backend
+	require.True(t, shouldRecreateBackend(generated.Backends[1], GetTestHAConfig("/", "").Backends[1]))
+}
+
+func TestSnapshotOutlierDetection(t *testing.T) {
+	cfg := GetTestConsulConfig()
+	cfg.Upstreams[0].OutlierDetection = &consul.OutlierDetection{
+		Observe:           consul.ObserveLayer7,
+		ConsecutiveErrors: 5,
+		Interval:          10 * time.Second,
+	}
+
+	generated, err := Generate(TestOpts, TestCertStore, State{}, cfg)
+	require.Nil(t, err)
+
+	expected := GetTestHAConfig("/", "")
+	withOutlierDetection(expected.Backends[1].Servers)
+	require.Equal(t, expected, generated)
+
+	// disabling it updates the existing servers
+	generated, err = Generate(TestOpts, TestCertStore, generated, GetTestConsulConfig())
+	require.Nil(t, err)
+	require.Equal(t, GetTestHAConfig("/", ""), generated)
+}
+
+func TestSnapshotLimits(t *testing.T) {
+	cfg := GetTestConsulConfig()
+	cfg.Upstreams[0].Limits = &consul.UpstreamLimits{
+		MaxConnections:     100,
+		MaxPendingRequests: 10,
+		QueueTimeout:       2 * time.Second,
+	}
+
+	generated, err := Generate(TestOpts, TestCertStore, State{}, cfg)
+	require.Nil(t, err)
+
+	expected := GetTestHAConfig("/", "")
+	expected.Backends[1].Backend.QueueTimeout = int64p(2000)
+	for i := range expected.Backends[1].Servers {
+		expected.Backends[1].Servers[i].Maxconn = int64p(100)
+		expected.Backends[1].Servers[i].Maxqueue = int64p(10)
+	}
+	require.Equal(t, expected, generated)
+
+	// removing them updates the existing servers
+	generated, err = Generate(TestOpts, TestCertStore, generated, GetTestConsulConfig())
+	require.Nil(t, err)
+	require.Equal(t, GetTestHAConfig("/", ""), generated)
+}
+
+func withOutlierDetection(servers []models.Server) {
+	for i := range servers {
+		servers[i].Check = models.ServerCheckEnabled
+		servers[i].Inter = int64p(10000)
+		servers[i].Observe = consul.ObserveLayer7
+		servers[i].ErrorLimit = 5
+		servers[i].OnError = models.ServerOnErrorMarkDown
+	}
+}
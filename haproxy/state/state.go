@@ -12,10 +12,13 @@ type FrontendFilter struct {
 }
 
 type Frontend struct {
-	Frontend  models.Frontend
-	Bind      models.Bind
-	LogTarget *models.LogTarget
-	Filter    *FrontendFilter
+	Frontend              models.Frontend
+	Bind                  models.Bind
+	LogTarget             *models.LogTarget
+	Filter                *FrontendFilter
+	TCPRequestRules       []models.TCPRequestRule
+	HTTPRequestRules      []models.HTTPRequestRule
+	BackendSwitchingRules []models.BackendSwitchingRule
 }
 
 type Backend struct {
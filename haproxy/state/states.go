@@ -2,7 +2,9 @@ package state
 
 import (
 	"fmt"
+	"net"
 	"sort"
+	"strconv"
 	"time"
 
 	"github.com/haproxytech/haproxy-consul-connect/consul"
@@ -19,6 +21,14 @@ type Options struct {
 	LogSocket        string
 	SPOEConfigPath   string
 	SPOESocket       string
+	// SPOEAddress is the address of a standalone SPOE agent, used instead
+	// of SPOESocket when set
+	SPOEAddress  string
+	SPOECAFile   string
+	SPOECertFile string
+	// SocketDir is where the unix sockets chaining internal frontends
+	// are created
+	SocketDir string
 }
 
 type CertificateStore interface {
@@ -38,6 +48,7 @@ type HAProxy interface {
 	CreateTCPRequestRule(parentType, parentName string, rule models.TCPRequestRule) error
 	CreateLogTargets(parentType, parentName string, rule models.LogTarget) error
 	CreateHTTPRequestRule(parentType, parentName string, rule models.HTTPRequestRule) error
+	CreateBackendSwitchingRule(feName string, rule models.BackendSwitchingRule) error
 }
 
 func Generate(opts Options, certStore CertificateStore, oldState State, cfg consul.Config) (State, error) {
@@ -46,6 +57,10 @@ func Generate(opts Options, certStore CertificateStore, oldState State, cfg cons
 	var err error
 
 	if opts.EnableIntentions {
+		spoe, err := spoeServer(opts)
+		if err != nil {
+			return newState, err
+		}
 		newState.Backends = append(newState.Backends, Backend{
 			Backend: models.Backend{
 				Name:           "spoe_back",
@@ -53,16 +68,18 @@ func Generate(opts Options, certStore CertificateStore, oldState State, cfg cons
 				ConnectTimeout: int64p(int(spoeTimeout.Milliseconds())),
 				Mode:           models.BackendModeTCP,
 			},
-			Servers: []models.Server{
-				models.Server{
-					Name:    "haproxy_connect",
-					Address: fmt.Sprintf("unix@%s", opts.SPOESocket),
-				},
-			},
+			Servers: []models.Server{spoe},
 		})
 	}
 
-	newState, err = generateDownstream(opts, certStore, cfg.Downstream, newState)
+	switch cfg.Gateway {
+	case "":
+		newState, err = generateDownstream(opts, certStore, cfg.Downstream, newState)
+	case consul.GatewayTerminating:
+		newState, err = generateTerminatingGateway(opts, certStore, cfg, oldState, newState)
+	case consul.GatewayMesh:
+		newState, err = generateMeshGateway(opts, cfg, oldState, newState)
+	}
 	if err != nil {
 		return newState, err
 	}
@@ -79,3 +96,34 @@ func Generate(opts Options, certStore CertificateStore, oldState State, cfg cons
 
 	return newState, nil
 }
+
+// spoeServer returns the server of the SPOE agent, reached with TLS when a
+// standalone agent is used with a CA
+func spoeServer(opts Options) (models.Server, error) {
+	srv := models.Server{
+		Name:    "haproxy_connect",
+		Address: fmt.Sprintf("unix@%s", opts.SPOESocket),
+	}
+	if opts.SPOEAddress == "" {
+		return srv, nil
+	}
+
+	host, port, err := net.SplitHostPort(opts.SPOEAddress)
+	if err != nil {
+		return srv, fmt.Errorf("invalid spoe address %s: %s", opts.SPOEAddress, err)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return srv, fmt.Errorf("invalid spoe address %s: bad port %s", opts.SPOEAddress, port)
+	}
+	srv.Address = host
+	srv.Port = int64p(p)
+	if opts.SPOECAFile != "" {
+		srv.Ssl = models.ServerSslEnabled
+		srv.SslCafile = opts.SPOECAFile
+		srv.SslCertificate = opts.SPOECertFile
+		srv.Verify = models.BindVerifyRequired
+	}
+
+	return srv, nil
+}
@@ -0,0 +1,157 @@
+package state
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/models/v2"
+)
+
+const terminatingFrontend = "front_terminating"
+
+// TerminatingFrontendName returns the name of the frontend terminating the
+// mTLS connections for service in namespace
+func TerminatingFrontendName(namespace, service string) string {
+	return fmt.Sprintf("%s_%s", terminatingFrontend, terminatingName(namespace, service))
+}
+
+// terminatingName identifies a terminated service in the generated names.
+// Services with the same name can be linked from different namespaces, which
+// cannot contain underscores.
+func terminatingName(namespace, service string) string {
+	return fmt.Sprintf("%s_%s", namespace, service)
+}
+
+// generateTerminatingGateway routes the incoming connections on their SNI to
+// one frontend per service. Each of them terminates mTLS with the leaf cert of
+// the service, enforces intentions and proxies to the external service nodes.
+func generateTerminatingGateway(opts Options, certStore CertificateStore, cfg consul.Config, oldState, newState State) (State, error) {
+	router := sniRouterFrontend(terminatingFrontend, cfg.Downstream)
+
+	for _, s := range cfg.TerminatingServices {
+		name := terminatingName(s.Namespace, s.Name)
+		feName := TerminatingFrontendName(s.Namespace, s.Name)
+		sniBeName := fmt.Sprintf("sni_terminating_%s", name)
+		beName := fmt.Sprintf("back_terminating_%s", name)
+		sock := fmt.Sprintf("unix@%s", path.Join(opts.SocketDir, fmt.Sprintf("terminating_%s.sock", name)))
+
+		router.BackendSwitchingRules = append(router.BackendSwitchingRules, models.BackendSwitchingRule{
+			Index:    int64p(len(router.BackendSwitchingRules)),
+			Name:     sniBeName,
+			Cond:     models.BackendSwitchingRuleCondIf,
+			CondTest: fmt.Sprintf("{ req.ssl_sni -m str %s }", s.SNI),
+		})
+
+		newState.Backends = append(newState.Backends, Backend{
+			Backend: models.Backend{
+				Name:           sniBeName,
+				ServerTimeout:  int64p(int(s.ReadTimeout.Milliseconds())),
+				ConnectTimeout: int64p(int(s.ConnectTimeout.Milliseconds())),
+				Mode:           models.BackendModeTCP,
+			},
+			Servers: []models.Server{
+				{
+					Name:        "terminating",
+					Address:     sock,
+					SendProxyV2: models.ServerSendProxyV2Enabled,
+				},
+			},
+		})
+
+		caPath, crtPath, err := certStore.CertsPath(s.TLS)
+		if err != nil {
+			return newState, err
+		}
+
+		fe := Frontend{
+			Frontend: models.Frontend{
+				Name:           feName,
+				DefaultBackend: beName,
+				ClientTimeout:  int64p(int(s.ReadTimeout.Milliseconds())),
+				Mode:           models.FrontendModeTCP,
+			},
+			Bind: models.Bind{
+				Name:           fmt.Sprintf("%s_bind", feName),
+				Address:        sock,
+				AcceptProxy:    true,
+				Ssl:            true,
+				SslCertificate: crtPath,
+				SslCafile:      caPath,
+				Verify:         models.BindVerifyRequired,
+			},
+		}
+		if opts.LogRequests && opts.LogSocket != "" {
+			fe.LogTarget = &models.LogTarget{
+				Index:    int64p(0),
+				Address:  opts.LogSocket,
+				Facility: models.LogTargetFacilityLocal0,
+				Format:   models.LogTargetFormatRfc5424,
+			}
+		}
+		if opts.EnableIntentions {
+			fe.Filter = intentionsFilter(opts, fe.Frontend.Mode)
+		}
+		newState.Frontends = append(newState.Frontends, fe)
+
+		be := Backend{
+			Backend: models.Backend{
+				Name:           beName,
+				ServerTimeout:  int64p(int(s.ReadTimeout.Milliseconds())),
+				ConnectTimeout: int64p(int(s.ConnectTimeout.Milliseconds())),
+				Balance: &models.Balance{
+					Algorithm: stringp(models.BalanceAlgorithmLeastconn),
+				},
+				Mode: models.BackendModeTCP,
+			},
+		}
+		if opts.LogRequests && opts.LogSocket != "" {
+			be.LogTarget = &models.LogTarget{
+				Index:    int64p(0),
+				Address:  opts.LogSocket,
+				Facility: models.LogTargetFacilityLocal0,
+				Format:   models.LogTargetFormatRfc5424,
+			}
+		}
+
+		tmpl, err := externalServerTemplate(certStore, s.ExternalTLS)
+		if err != nil {
+			return newState, err
+		}
+		be.Servers = generateServers(tmpl, s.Nodes, beName, oldState)
+		newState.Backends = append(newState.Backends, be)
+	}
+
+	newState.Frontends = append(newState.Frontends, router)
+
+	return newState, nil
+}
+
+// externalServerTemplate returns the TLS settings of the servers of an
+// external service
+func externalServerTemplate(certStore CertificateStore, tls *consul.ExternalTLS) (models.Server, error) {
+	srv := models.Server{}
+	if tls == nil {
+		return srv, nil
+	}
+
+	caPath, crtPath, err := certStore.CertsPath(tls.TLS)
+	if err != nil {
+		return srv, err
+	}
+
+	srv.Ssl = models.ServerSslEnabled
+	srv.Verify = models.BindVerifyNone
+	if len(tls.CAs) > 0 {
+		srv.SslCafile = caPath
+		srv.Verify = models.BindVerifyRequired
+	}
+	if len(tls.Cert) > 0 {
+		srv.SslCertificate = crtPath
+	}
+	if tls.SNI != "" {
+		srv.Sni = fmt.Sprintf("str(%s)", tls.SNI)
+	}
+
+	return srv, nil
+}
@@ -2,22 +2,28 @@ package state
 
 import (
 	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
 
 	"github.com/haproxytech/haproxy-consul-connect/consul"
 	"github.com/haproxytech/models/v2"
+	"github.com/hashicorp/consul/agent/connect"
 )
 
+// splitRange is the range of the random number used to split traffic
+// between the targets of a route
+const splitRange = 10000
+
 func generateUpstream(opts Options, certStore CertificateStore, cfg consul.Upstream, oldState, newState State) (State, error) {
 	feName := fmt.Sprintf("front_%s", cfg.Name)
 	beName := fmt.Sprintf("back_%s", cfg.Name)
 	feMode := models.FrontendModeHTTP
-	beMode := models.BackendModeHTTP
 
 	fePort64 := int64(cfg.LocalBindPort)
 
 	if cfg.Protocol != "" && cfg.Protocol == "tcp" {
 		feMode = models.FrontendModeTCP
-		beMode = models.BackendModeTCP
 	}
 
 	fe := Frontend{
@@ -43,19 +49,81 @@ func generateUpstream(opts Options, certStore CertificateStore, cfg consul.Upstr
 		}
 	}
 
+	if len(cfg.Routes) == 0 {
+		be, err := generateUpstreamBackend(opts, certStore, cfg, beName, consul.UpstreamTarget{
+			ConnectTimeout: cfg.ConnectTimeout,
+			SNI:            cfg.SNI,
+			SpiffeID:       cfg.SpiffeID,
+			Balance:        cfg.Balance,
+			Nodes:          cfg.Nodes,
+		}, oldState)
+		if err != nil {
+			return newState, err
+		}
+		newState.Frontends = append(newState.Frontends, fe)
+		newState.Backends = append(newState.Backends, be)
+		return newState, nil
+	}
+
+	// Discovery chain: one backend per target, and switching rules for the routes
+	targetBackends := map[string]string{}
+	for _, t := range cfg.Targets {
+		name := fmt.Sprintf("%s_%s", beName, t.Name)
+		if t.ConnectTimeout == 0 {
+			t.ConnectTimeout = cfg.ConnectTimeout
+		}
+
+		be, err := generateUpstreamBackend(opts, certStore, cfg, name, t, oldState)
+		if err != nil {
+			return newState, err
+		}
+		newState.Backends = append(newState.Backends, be)
+		targetBackends[t.Name] = name
+	}
+
+	// without a catch-all route, requests matching no route are rejected
+	defaultBackend, switchingRules, split, err := upstreamRoutes(cfg.Routes, targetBackends)
+	if err != nil {
+		return newState, fmt.Errorf("upstream %s: %s", cfg.Name, err)
+	}
+	fe.Frontend.DefaultBackend = defaultBackend
+	fe.BackendSwitchingRules = switchingRules
+	if split && feMode == models.FrontendModeHTTP {
+		fe.HTTPRequestRules = []models.HTTPRequestRule{
+			{
+				Index:    int64p(0),
+				Type:     models.HTTPRequestRuleTypeSetVar,
+				VarScope: "txn",
+				VarName:  "connect.split",
+				VarExpr:  fmt.Sprintf("rand(%d)", splitRange),
+			},
+		}
+	}
+
 	newState.Frontends = append(newState.Frontends, fe)
 
+	return newState, nil
+}
+
+func generateUpstreamBackend(opts Options, certStore CertificateStore, cfg consul.Upstream, beName string, target consul.UpstreamTarget, oldState State) (Backend, error) {
+	beMode := models.BackendModeHTTP
+	if cfg.Protocol != "" && cfg.Protocol == "tcp" {
+		beMode = models.BackendModeTCP
+	}
+
 	be := Backend{
 		Backend: models.Backend{
 			Name:           beName,
 			ServerTimeout:  int64p(int(cfg.ReadTimeout.Milliseconds())),
-			ConnectTimeout: int64p(int(cfg.ConnectTimeout.Milliseconds())),
-			Balance: &models.Balance{
-				Algorithm: stringp(models.BalanceAlgorithmLeastconn),
-			},
-			Mode: beMode,
+			ConnectTimeout: int64p(int(target.ConnectTimeout.Milliseconds())),
+			Balance:        upstreamBalance(target.Balance),
+			HashType:       upstreamHashType(target.Balance),
+			Mode:           beMode,
 		},
 	}
+	if l := cfg.Limits; l != nil && l.QueueTimeout > 0 {
+		be.Backend.QueueTimeout = int64p(int(l.QueueTimeout.Milliseconds()))
+	}
 	if opts.LogRequests && opts.LogSocket != "" {
 		be.LogTarget = &models.LogTarget{
 			Index:    int64p(0),
@@ -65,17 +133,326 @@ func generateUpstream(opts Options, certStore CertificateStore, cfg consul.Upstr
 		}
 	}
 
-	servers, err := generateUpstreamServers(opts, certStore, cfg, beName, oldState)
+	servers, err := generateUpstreamServers(opts, certStore, cfg, target, beName, oldState)
 	if err != nil {
-		return newState, err
+		return be, err
 	}
 	be.Servers = servers
-	newState.Backends = append(newState.Backends, be)
 
-	return newState, nil
+	// spread the traffic over all the backup servers, HAProxy only uses the
+	// first available one otherwise
+	for _, s := range servers {
+		if s.Backup == models.ServerBackupEnabled {
+			be.Backend.Allbackups = models.BackendAllbackupsEnabled
+			break
+		}
+	}
+
+	return be, nil
 }
 
-func generateUpstreamServers(opts Options, certStore CertificateStore, cfg consul.Upstream, beName string, oldState State) ([]models.Server, error) {
+// upstreamBalance returns the balance settings of a backend, using
+// leastconn by default
+func upstreamBalance(b consul.UpstreamBalance) *models.Balance {
+	if b.Algorithm == "" {
+		return &models.Balance{
+			Algorithm: stringp(models.BalanceAlgorithmLeastconn),
+		}
+	}
+	return &models.Balance{
+		Algorithm: stringp(b.Algorithm),
+		HdrName:   b.HdrName,
+		URLParam:  b.URLParam,
+	}
+}
+
+// upstreamHashType returns the consistent hashing of the backends balanced
+// with a hashing algorithm, so that changing their servers only remaps a
+// part of the requests. Other backends keep the default map-based hashing.
+func upstreamHashType(b consul.UpstreamBalance) *models.BackendHashType {
+	switch b.Algorithm {
+	case consul.BalanceSource, consul.BalanceHdr, consul.BalanceURLParam:
+		return &models.BackendHashType{
+			Method: models.BackendHashTypeMethodConsistent,
+		}
+	}
+	return nil
+}
+
+// upstreamRoutes converts routes into backend switching rules. Weighted
+// splits are implemented by drawing a random number per request and
+// comparing it to the cumulated split weights. The default backend is the
+// last one of the first catch-all route, or empty when no route matches all
+// requests. Splits to unknown targets are ignored.
+func upstreamRoutes(routes []consul.UpstreamRoute, backends map[string]string) (string, []models.BackendSwitchingRule, bool, error) {
+	var rules []models.BackendSwitchingRule
+	split := false
+
+	addRule := func(backend, cond string) {
+		rules = append(rules, models.BackendSwitchingRule{
+			Index:    int64p(len(rules)),
+			Name:     backend,
+			Cond:     models.BackendSwitchingRuleCondIf,
+			CondTest: cond,
+		})
+	}
+
+	for _, r := range routes {
+		cond, err := routeCondition(r.Match)
+		if err != nil {
+			return "", nil, false, err
+		}
+
+		splits := make([]consul.UpstreamSplit, 0, len(r.Splits))
+		for _, s := range r.Splits {
+			if _, ok := backends[s.Target]; ok {
+				splits = append(splits, s)
+			}
+		}
+		if len(splits) == 0 {
+			continue
+		}
+
+		cumulated := float32(0)
+		for _, s := range splits[:len(splits)-1] {
+			split = true
+			cumulated += s.Weight
+			addRule(backends[s.Target], strings.TrimSpace(fmt.Sprintf("%s { var(txn.connect.split) -m int lt %d }", cond, int(cumulated*splitRange/100+0.5))))
+		}
+
+		last := backends[splits[len(splits)-1].Target]
+		if cond == "" {
+			// catch-all route, the following ones are unreachable
+			return last, rules, split, nil
+		}
+		addRule(last, cond)
+	}
+
+	return "", rules, split, nil
+}
+
+// routeCondition converts the match of a route into an ACL condition. The
+// values of the match are quoted, and the ones HAProxy cannot express are
+// rejected.
+func routeCondition(m consul.UpstreamRouteMatch) (string, error) {
+	conds := []string{}
+	add := func(fetch, match string, values ...string) error {
+		patterns, err := aclPatterns(values)
+		if err != nil {
+			return err
+		}
+		parts := []string{"{", fetch}
+		for _, p := range []string{match, patterns} {
+			if p != "" {
+				parts = append(parts, p)
+			}
+		}
+		conds = append(conds, strings.Join(append(parts, "}"), " "))
+		return nil
+	}
+
+	if len(m.Hosts) > 0 {
+		if err := add("req.hdr(host),field(1,:)", "-m reg -i", hostsRegex(m.Hosts)); err != nil {
+			return "", err
+		}
+	}
+	if m.PathExact != "" {
+		if err := add("path", "", m.PathExact); err != nil {
+			return "", err
+		}
+	}
+	if m.PathPrefix != "" {
+		if err := add("path_beg", "", m.PathPrefix); err != nil {
+			return "", err
+		}
+	}
+	if m.PathRegex != "" {
+		if err := add("path_reg", "", m.PathRegex); err != nil {
+			return "", err
+		}
+	}
+	if len(m.Methods) > 0 {
+		if err := add("method", "", m.Methods...); err != nil {
+			return "", err
+		}
+	}
+
+	for _, h := range m.Headers {
+		if err := checkFetchArg(h.Name); err != nil {
+			return "", err
+		}
+		fetch := fmt.Sprintf("req.hdr(%s)", h.Name)
+		n := len(conds)
+		var err error
+		switch {
+		case h.Present:
+			err = add(fetch, "-m found")
+		case h.Exact != "":
+			err = add(fetch, "-m str", h.Exact)
+		case h.Prefix != "":
+			err = add(fetch, "-m beg", h.Prefix)
+		case h.Suffix != "":
+			err = add(fetch, "-m end", h.Suffix)
+		case h.Regex != "":
+			err = add(fetch, "-m reg", h.Regex)
+		default:
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if h.Invert {
+			conds[n] = "!" + conds[n]
+		}
+	}
+
+	for _, q := range m.QueryParams {
+		if err := checkFetchArg(q.Name); err != nil {
+			return "", err
+		}
+		fetch := fmt.Sprintf("url_param(%s)", q.Name)
+		var err error
+		switch {
+		case q.Present:
+			err = add(fetch, "-m found")
+		case q.Exact != "":
+			err = add(fetch, "-m str", q.Exact)
+		case q.Regex != "":
+			err = add(fetch, "-m reg", q.Regex)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return strings.Join(conds, " "), nil
+}
+
+// aclSafePattern matches the patterns which need no quoting
+var aclSafePattern = regexp.MustCompile(`^[a-zA-Z0-9/_.:@%+=,~*-]+$`)
+
+// aclPatterns returns the patterns of an ACL, single quoted when they hold
+// characters HAProxy would interpret. The end of the flags is marked when a
+// pattern could be taken for one. A closing brace cannot be told from the
+// end of an anonymous ACL, even quoted.
+func aclPatterns(values []string) (string, error) {
+	res := make([]string, 0, len(values)+1)
+	for _, v := range values {
+		if v == "}" {
+			return "", fmt.Errorf("invalid route match value %s", v)
+		}
+		if strings.HasPrefix(v, "-") && len(res) == 0 {
+			res = append(res, "--")
+		}
+		if !aclSafePattern.MatchString(v) {
+			v = "'" + strings.Replace(v, "'", `'\''`, -1) + "'"
+		}
+		res = append(res, v)
+	}
+	return strings.Join(res, " "), nil
+}
+
+// checkFetchArg checks name can be the argument of a sample fetch
+func checkFetchArg(name string) error {
+	if name == "" || strings.ContainsAny(name, ",()'\"\\#{} \t") {
+		return fmt.Errorf("invalid route match name %q", name)
+	}
+	return nil
+}
+
+func generateUpstreamServers(opts Options, certStore CertificateStore, cfg consul.Upstream, target consul.UpstreamTarget, beName string, oldState State) ([]models.Server, error) {
+	caPath, crtPath, err := certStore.CertsPath(cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := models.Server{
+		Ssl:            models.ServerSslEnabled,
+		SslCertificate: crtPath,
+		SslCafile:      caPath,
+		Verify:         models.BindVerifyRequired,
+	}
+	if target.SNI != "" {
+		tmpl.Sni = fmt.Sprintf("str(%s)", target.SNI)
+	}
+	if target.SpiffeID != "" {
+		host, err := verifyHost(target.SpiffeID)
+		if err != nil {
+			return nil, err
+		}
+		tmpl.Verifyhost = host
+	}
+	if od := cfg.OutlierDetection; od != nil {
+		// the servers are marked down after ErrorLimit errors, and back up
+		// once their health checks succeed
+		tmpl.Check = models.ServerCheckEnabled
+		tmpl.Inter = int64p(int(od.Interval.Milliseconds()))
+		tmpl.Observe = od.Observe
+		tmpl.ErrorLimit = int64(od.ConsecutiveErrors)
+		tmpl.OnError = models.ServerOnErrorMarkDown
+	}
+	if l := cfg.Limits; l != nil {
+		// connections above maxconn wait in the queue of the server, or of
+		// the backend once it is full
+		tmpl.Maxconn = int64p(l.MaxConnections)
+		if l.MaxPendingRequests > 0 {
+			tmpl.Maxqueue = int64p(l.MaxPendingRequests)
+		}
+	}
+
+	servers := generateServers(tmpl, target.Nodes, beName, oldState)
+
+	// nodes of failover targets can have another identity than target
+	identities := map[string]consul.UpstreamNode{}
+	for _, n := range target.Nodes {
+		if n.SNI != "" || n.SpiffeID != "" {
+			identities[fmt.Sprintf("%s:%d", n.Host, n.Port)] = n
+		}
+	}
+	for i, s := range servers {
+		if s.Maintenance == models.ServerMaintenanceEnabled {
+			continue
+		}
+		n, ok := identities[fmt.Sprintf("%s:%d", s.Address, *s.Port)]
+		if !ok {
+			continue
+		}
+		if n.SNI != "" {
+			servers[i].Sni = fmt.Sprintf("str(%s)", n.SNI)
+		}
+		if n.SpiffeID != "" {
+			host, err := verifyHost(n.SpiffeID)
+			if err != nil {
+				return nil, err
+			}
+			servers[i].Verifyhost = host
+		}
+	}
+
+	return servers, nil
+}
+
+// verifyHost returns the name to check the server certificates against to
+// make sure they belong to the service identified by spiffeID. HAProxy cannot
+// match URI SANs, so the common name consul derives from it is used instead.
+// It only holds the service, its namespace and a prefix of the trust domain:
+// the datacenter and the rest of the trust domain are not verified.
+func verifyHost(spiffeID string) (string, error) {
+	u, err := url.Parse(spiffeID)
+	if err != nil {
+		return "", err
+	}
+	id, err := consul.ParseSpiffeID(u)
+	if err != nil {
+		return "", err
+	}
+	return connect.ServiceCN(id.Service, id.Namespace, id.Host), nil
+}
+
+// generateServers builds the servers of a backend from nodes. Servers keep
+// their slot across updates to allow changing them at runtime, removed ones
+// are put in maintenance. tmpl holds the settings common to all servers.
+func generateServers(tmpl models.Server, nodes []consul.UpstreamNode, beName string, oldState State) []models.Server {
 	oldBackend, _ := oldState.findBackend(beName)
 
 	idxHANode := func(s models.Server) string {
@@ -94,25 +471,15 @@ func generateUpstreamServers(opts Options, certStore CertificateStore, cfg consu
 		return idxHANode(servers[i])
 	})
 
-	newServersIdx := index(cfg.Nodes, func(i int) string {
-		return idxConsulNode(cfg.Nodes[i])
+	newServersIdx := index(nodes, func(i int) string {
+		return idxConsulNode(nodes[i])
 	})
 
-	caPath, crtPath, err := certStore.CertsPath(cfg.TLS)
-	if err != nil {
-		return nil, err
-	}
-
-	disabledServer := models.Server{
-		Address:        "127.0.0.1",
-		Port:           int64p(1),
-		Weight:         int64p(1),
-		Ssl:            models.ServerSslEnabled,
-		SslCertificate: crtPath,
-		SslCafile:      caPath,
-		Verify:         models.BindVerifyRequired,
-		Maintenance:    models.ServerMaintenanceEnabled,
-	}
+	disabledServer := tmpl
+	disabledServer.Address = "127.0.0.1"
+	disabledServer.Port = int64p(1)
+	disabledServer.Weight = int64p(1)
+	disabledServer.Maintenance = models.ServerMaintenanceEnabled
 
 	emptyServerSlots := make([]int, 0, len(servers))
 
@@ -129,12 +496,13 @@ func generateUpstreamServers(opts Options, certStore CertificateStore, cfg consu
 	}
 
 	// Add new servers
-	for _, s := range cfg.Nodes {
+	for _, s := range nodes {
 		i, ok := serversIdx[idxConsulNode(s)]
 		if ok {
-			// if the server exists, just update its certificate in case they changed
-			servers[i].SslCafile = caPath
-			servers[i].SslCertificate = crtPath
+			// if the server exists, just update its settings in case they changed
+			applyServerTemplate(&servers[i], tmpl)
+			servers[i].Weight = int64p(s.Weight)
+			servers[i].Backup = serverBackup(s.Backup)
 			continue
 		}
 
@@ -155,11 +523,59 @@ func generateUpstreamServers(opts Options, certStore CertificateStore, cfg consu
 		i = emptyServerSlots[0]
 		emptyServerSlots = emptyServerSlots[1:]
 
+		applyServerTemplate(&servers[i], tmpl)
 		servers[i].Address = s.Host
 		servers[i].Port = int64p(s.Port)
 		servers[i].Weight = int64p(s.Weight)
+		servers[i].Backup = serverBackup(s.Backup)
 		servers[i].Maintenance = models.ServerMaintenanceDisabled
 	}
 
-	return servers, nil
+	return servers
+}
+
+// applyServerTemplate updates the settings of srv common to all servers
+func applyServerTemplate(srv *models.Server, tmpl models.Server) {
+	srv.SslCafile = tmpl.SslCafile
+	srv.SslCertificate = tmpl.SslCertificate
+	srv.Sni = tmpl.Sni
+	srv.Verifyhost = tmpl.Verifyhost
+	srv.Check = tmpl.Check
+	srv.Inter = tmpl.Inter
+	srv.Observe = tmpl.Observe
+	srv.ErrorLimit = tmpl.ErrorLimit
+	srv.OnError = tmpl.OnError
+	srv.Maxconn = tmpl.Maxconn
+	srv.Maxqueue = tmpl.Maxqueue
+}
+
+func serverBackup(backup bool) string {
+	if backup {
+		return models.ServerBackupEnabled
+	}
+	return ""
+}
+
+// hostsRegex builds a regex matching any of hosts, which can start
+// or end with a wildcard
+func hostsRegex(hosts []string) string {
+	res := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		if h == "*" {
+			res = append(res, ".*")
+			continue
+		}
+
+		prefix, suffix := "", ""
+		if strings.HasPrefix(h, "*.") {
+			prefix = "[^.]+"
+			h = strings.TrimPrefix(h, "*")
+		}
+		if strings.HasSuffix(h, ".*") {
+			suffix = ".*"
+			h = strings.TrimSuffix(h, "*")
+		}
+		res = append(res, prefix+regexp.QuoteMeta(h)+suffix)
+	}
+	return fmt.Sprintf("^(%s)$", strings.Join(res, "|"))
 }
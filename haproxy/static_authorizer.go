@@ -0,0 +1,151 @@
+package haproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/haproxy-consul-connect/lib"
+	log "github.com/sirupsen/logrus"
+)
+
+const staticPolicyReloadInterval = 5 * time.Second
+
+// staticPolicy is the content of a static policy file, for example:
+//
+//	{
+//	  "Default": "allow",
+//	  "Rules": [
+//	    {"Source": "web", "Target": "db", "Action": "deny"},
+//	    {"Source": "*", "Target": "api", "Action": "deny", "HTTP": {"PathPrefix": "/admin"}}
+//	  ]
+//	}
+type staticPolicy struct {
+	Default string
+	Rules   []staticRule
+}
+
+// staticRule matches requests from Source to Target, which can be the *
+// wildcard, and HTTP requests matching HTTP when set
+type staticRule struct {
+	Source string
+	Target string
+	Action string
+	HTTP   *consul.IntentionHTTPPermission
+}
+
+// StaticAuthorizer authorizes requests according to a policy file, reloaded
+// when it changes. The first matching rule decides, or the policy default.
+// Rules with HTTP conditions only apply to HTTP requests.
+type StaticAuthorizer struct {
+	path string
+
+	lock    sync.RWMutex
+	policy  staticPolicy
+	modTime time.Time
+}
+
+func NewStaticAuthorizer(path string, sd *lib.Shutdown) (*StaticAuthorizer, error) {
+	a := &StaticAuthorizer{
+		path: path,
+	}
+
+	_, err := a.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		ticker := time.NewTicker(staticPolicyReloadInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-sd.Stop:
+				return
+			case <-ticker.C:
+				reloaded, err := a.reload()
+				if err != nil {
+					log.Errorf("static authorizer: error reloading %s, keeping the previous policy: %s", path, err)
+					continue
+				}
+				if reloaded {
+					log.Infof("static authorizer: reloaded %s", path)
+				}
+			}
+		}
+	}()
+
+	return a, nil
+}
+
+// reload reads the policy file if it changed since the last load
+func (a *StaticAuthorizer) reload() (bool, error) {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return false, err
+	}
+
+	a.lock.RLock()
+	unchanged := info.ModTime().Equal(a.modTime)
+	a.lock.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	b, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		return false, err
+	}
+
+	var policy staticPolicy
+	err = json.Unmarshal(b, &policy)
+	if err != nil {
+		return false, err
+	}
+	if err := validateStaticAction(policy.Default); err != nil {
+		return false, fmt.Errorf("default: %s", err)
+	}
+	for i, r := range policy.Rules {
+		if err := validateStaticAction(r.Action); err != nil {
+			return false, fmt.Errorf("rule %d: %s", i, err)
+		}
+	}
+
+	a.lock.Lock()
+	a.policy = policy
+	a.modTime = info.ModTime()
+	a.lock.Unlock()
+
+	return true, nil
+}
+
+func validateStaticAction(action string) error {
+	switch action {
+	case "allow", "deny":
+		return nil
+	default:
+		return fmt.Errorf("invalid action %q, expected allow or deny", action)
+	}
+}
+
+// Authorize implements Authorizer
+func (a *StaticAuthorizer) Authorize(req AuthRequest) (bool, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	for _, r := range a.policy.Rules {
+		if !intentionNameMatch(r.Source, req.Source.Service) || !intentionNameMatch(r.Target, req.Target) {
+			continue
+		}
+		if r.HTTP != nil && (req.HTTP == nil || !httpPermissionMatch(r.HTTP, req.HTTP)) {
+			continue
+		}
+		return r.Action == "allow", nil
+	}
+
+	return a.policy.Default == "allow", nil
+}
@@ -0,0 +1,85 @@
+package haproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+	"github.com/haproxytech/haproxy-consul-connect/lib"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticAuthorizer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authz")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	policyPath := path.Join(dir, "policy.json")
+	err = ioutil.WriteFile(policyPath, []byte(`{
+		"Default": "allow",
+		"Rules": [
+			{"Source": "web", "Target": "db", "Action": "deny"},
+			{"Source": "*", "Target": "api", "Action": "deny", "HTTP": {"PathPrefix": "/admin"}}
+		]
+	}`), 0600)
+	require.NoError(t, err)
+
+	sd := lib.NewShutdown()
+	defer sd.Shutdown("test end")
+
+	a, err := NewStaticAuthorizer(policyPath, sd)
+	require.NoError(t, err)
+
+	web := &consul.SpiffeID{Namespace: "default", Datacenter: "dc1", Service: "web"}
+	authorize := func(target string, req *HTTPRequest) bool {
+		ok, err := a.Authorize(AuthRequest{Source: web, Target: target, HTTP: req})
+		require.NoError(t, err)
+		return ok
+	}
+
+	require.False(t, authorize("db", nil))
+	require.True(t, authorize("cache", nil))
+	require.True(t, authorize("api", nil))
+	require.True(t, authorize("api", &HTTPRequest{Method: "GET", Path: "/v1"}))
+	require.False(t, authorize("api", &HTTPRequest{Method: "GET", Path: "/admin/users"}))
+
+	err = ioutil.WriteFile(policyPath, []byte(`{"Default": "deny"}`), 0600)
+	require.NoError(t, err)
+	// make sure the modification time changes whatever the fs resolution
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(policyPath, future, future))
+	reloaded, err := a.reload()
+	require.NoError(t, err)
+	require.True(t, reloaded)
+	require.False(t, authorize("cache", nil))
+
+	err = ioutil.WriteFile(policyPath, []byte(`{"Default": "maybe"}`), 0600)
+	require.NoError(t, err)
+	future = future.Add(time.Minute)
+	require.NoError(t, os.Chtimes(policyPath, future, future))
+	_, err = a.reload()
+	require.Error(t, err)
+	require.False(t, authorize("cache", nil))
+}
+
+func TestChainAuthorizer(t *testing.T) {
+	allow := authorizerFunc(func(AuthRequest) (bool, error) { return true, nil })
+	deny := authorizerFunc(func(AuthRequest) (bool, error) { return false, nil })
+
+	ok, err := ChainAuthorizer{allow, allow}.Authorize(AuthRequest{})
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = ChainAuthorizer{allow, deny}.Authorize(AuthRequest{})
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+type authorizerFunc func(AuthRequest) (bool, error)
+
+func (f authorizerFunc) Authorize(req AuthRequest) (bool, error) {
+	return f(req)
+}
@@ -4,6 +4,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/haproxytech/haproxy-consul-connect/consul"
 	"github.com/haproxytech/models/v2"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -67,8 +68,29 @@ var (
 		Name: "haproxy_connect_bytes_out_in_total",
 		Help: "The total number of http requests",
 	}, []string{"service"})
+
+	upstreamDatacenter = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "haproxy_connect_upstream_datacenter",
+		Help: "The datacenter serving a prepared query upstream, which differs from the local one after a failover",
+	}, []string{"service", "target", "datacenter"})
+	serverDown = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "haproxy_connect_upstream_server_down",
+		Help: "Whether an upstream server is marked down, by outlier detection",
+	}, []string{"service", "target", "server"})
 )
 
+// SetUpstreamDatacenters reports the datacenters serving the upstreams of
+// cfg, when known
+func SetUpstreamDatacenters(cfg consul.Config) {
+	upstreamDatacenter.Reset()
+	for _, up := range cfg.Upstreams {
+		if up.Datacenter == "" {
+			continue
+		}
+		upstreamDatacenter.WithLabelValues(cfg.ServiceName, up.Name, up.Datacenter).Set(1)
+	}
+}
+
 func (s *Stats) runMetrics() {
 	upMetric.WithLabelValues(s.cfg.ServiceName).Set(1)
 	for {
@@ -78,6 +100,8 @@ func (s *Stats) runMetrics() {
 			log.Error(err)
 			continue
 		}
+		// servers removed since the last scrape are not reported anymore
+		serverDown.Reset()
 		for _, stat := range stats {
 			s.handle(stat)
 		}
@@ -146,4 +170,12 @@ func (s *Stats) handlebackend(stats *models.NativeStat) {
 
 func (s *Stats) handleServer(stats *models.NativeStat) {
 	resTimeOut.WithLabelValues(s.cfg.ServiceName, stats.Name).Set(statVal(stats.Stats.Ttime) / 1000)
+
+	targetService := strings.TrimPrefix(stats.BackendName, "back_")
+	down := 0.0
+	// servers down going back up report statuses like DOWN 1/2
+	if strings.HasPrefix(stats.Stats.Status, "DOWN") {
+		down = 1
+	}
+	serverDown.WithLabelValues(s.cfg.ServiceName, targetService, stats.Name).Set(down)
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"strings"
 
@@ -12,8 +13,6 @@ import (
 	"github.com/haproxytech/haproxy-consul-connect/haproxy/haproxy_cmd"
 	"github.com/haproxytech/haproxy-consul-connect/lib"
 
-	"github.com/hashicorp/consul/api"
-
 	"github.com/haproxytech/haproxy-consul-connect/consul"
 )
 
@@ -60,18 +59,30 @@ func validateRequirements(dataplaneBin, haproxyBin string) error {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "spoe-agent" {
+		runSPOEAgent(os.Args[2:])
+		return
+	}
+
 	versionFlag := flag.Bool("version", false, "Show version and exit")
 	logLevel := flag.String("log-level", "INFO", "Log level")
-	consulAddr := flag.String("http-addr", "127.0.0.1:8500", "Consul agent address")
+	consulFlags := registerConsulFlags(flag.CommandLine)
 	service := flag.String("sidecar-for", "", "The consul service id to proxy")
 	serviceTag := flag.String("sidecar-for-tag", "", "The consul service id to proxy")
+	gateway := flag.String("gateway", "", "Run as a gateway of the given kind instead of a sidecar: ingress, terminating, mesh")
+	gatewayService := flag.String("service", "", "The consul service name of the gateway")
 	haproxyBin := flag.String("haproxy", haproxy_cmd.DefaultHAProxyBin, "Haproxy binary path")
 	dataplaneBin := flag.String("dataplane", haproxy_cmd.DefaultDataplaneBin, "Dataplane binary path")
 	haproxyCfgBasePath := flag.String("haproxy-cfg-base-path", "/tmp", "Haproxy binary path")
 	statsListenAddr := flag.String("stats-addr", "", "Listen addr for stats server")
 	statsServiceRegister := flag.Bool("stats-service-register", false, "Register a consul service for connect stats")
 	enableIntentions := flag.Bool("enable-intentions", false, "Enable Connect intentions")
-	token := flag.String("token", "", "Consul ACL token")
+	auditLog := flag.String("audit-log", "", "Write the intentions decisions as JSON lines to a file, stdout or syslog://host:port")
+	auditLogMaxSize := flag.Int64("audit-log-max-size", 100, "Size in MB after which the audit log file is rotated, 0 to disable")
+	spoeAddress := flag.String("spoe-address", "", "Address of a standalone SPOE agent enforcing intentions instead of the embedded one")
+	spoeCAFile := flag.String("spoe-ca-file", "", "CA verifying the standalone SPOE agent, enables TLS")
+	spoeCertFile := flag.String("spoe-cert-file", "", "PEM certificate and key presented to the standalone SPOE agent")
+	authzPolicyFile := flag.String("authz-policy-file", "", "Static authorization policy file enforced along with intentions, reloaded on change")
 	flag.Parse()
 	if versionFlag != nil && *versionFlag {
 		fmt.Printf("Version: %s ; BuildTime: %s ; GitHash: %s\n", Version, BuildTime, GitHash)
@@ -89,20 +100,49 @@ func main() {
 	}
 	log.SetLevel(ll)
 
+	if *spoeAddress != "" {
+		if _, _, err := net.SplitHostPort(*spoeAddress); err != nil {
+			log.Fatalf("Invalid -spoe-address %s: %s", *spoeAddress, err)
+		}
+	}
+
 	sd := lib.NewShutdown()
 
-	consulConfig := &api.Config{
-		Address: *consulAddr,
-	}
-	if token != nil {
-		consulConfig.Token = *token
-	}
-	consulClient, err := api.NewClient(consulConfig)
+	consulClient, consulHTTP, err := consulFlags.client(sd)
 	if err != nil {
+		log.Fatal(err)
 	}
 
 	var serviceID string
-	if *serviceTag != "" {
+	var gatewayKind string
+	if *gateway != "" {
+		switch *gateway {
+		case "ingress":
+			gatewayKind = consul.GatewayIngress
+		case "terminating":
+			gatewayKind = consul.GatewayTerminating
+		case "mesh":
+			gatewayKind = consul.GatewayMesh
+		default:
+			log.Fatalf("Unknown gateway kind %s", *gateway)
+		}
+		if *gatewayService == "" {
+			log.Fatalf("Please specify -service with -gateway")
+		}
+		svcs, err := consulClient.Agent().Services()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, s := range svcs {
+			if s.Service == *gatewayService && string(s.Kind) == gatewayKind {
+				serviceID = s.ID
+				break
+			}
+		}
+		if serviceID == "" {
+			log.Fatalf("No %s service named %s found", gatewayKind, *gatewayService)
+		}
+	} else if *serviceTag != "" {
 		svcs, err := consulClient.Agent().Services()
 		if err != nil {
 			log.Fatal(err)
@@ -125,11 +165,17 @@ func main() {
 	} else if *service != "" {
 		serviceID = *service
 	} else {
-		log.Fatalf("Please specify -sidecar-for or -sidecar-for-tag")
+		log.Fatalf("Please specify -sidecar-for, -sidecar-for-tag or -gateway")
 	}
 
 	consulLogger := &consulLogger{}
-	watcher := consul.New(serviceID, consulClient, consulLogger)
+	var watcher *consul.Watcher
+	if gatewayKind != "" {
+		watcher = consul.NewGateway(gatewayKind, serviceID, consulClient, consulLogger)
+	} else {
+		watcher = consul.New(serviceID, consulClient, consulLogger)
+	}
+	watcher.SetHTTPClient(consulHTTP)
 	go func() {
 		if err := watcher.Run(); err != nil {
 			log.Error(err)
@@ -142,6 +188,12 @@ func main() {
 		DataplaneBin:         *dataplaneBin,
 		ConfigBaseDir:        *haproxyCfgBasePath,
 		EnableIntentions:     *enableIntentions,
+		SPOEAddress:          *spoeAddress,
+		SPOECAFile:           *spoeCAFile,
+		SPOECertFile:         *spoeCertFile,
+		AuthzPolicyFile:      *authzPolicyFile,
+		AuditLog:             *auditLog,
+		AuditLogMaxSize:      *auditLogMaxSize * 1024 * 1024,
 		StatsListenAddr:      *statsListenAddr,
 		StatsRegisterService: *statsServiceRegister,
 		LogRequests:          ll == log.TraceLevel,
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+
+	log "github.com/sirupsen/logrus"
+
+	haproxy "github.com/haproxytech/haproxy-consul-connect/haproxy"
+	"github.com/haproxytech/haproxy-consul-connect/lib"
+
+	"github.com/haproxytech/haproxy-consul-connect/consul"
+)
+
+// runSPOEAgent runs the SPOE intentions agent standalone, to be shared by
+// several HAProxy instances started with -spoe-address
+func runSPOEAgent(args []string) {
+	flags := flag.NewFlagSet("spoe-agent", flag.ExitOnError)
+	logLevel := flags.String("log-level", "INFO", "Log level")
+	consulFlags := registerConsulFlags(flags)
+	listenAddr := flags.String("listen", "127.0.0.1:9101", "Listen address, host:port or unix@path")
+	tlsCertFile := flags.String("tls-cert-file", "", "Certificate served to HAProxy, enables TLS")
+	tlsKeyFile := flags.String("tls-key-file", "", "Key of the certificate served to HAProxy")
+	tlsCAFile := flags.String("tls-ca-file", "", "CA verifying the HAProxy client certificates")
+	auditLog := flags.String("audit-log", "", "Write the intentions decisions as JSON lines to a file, stdout or syslog://host:port")
+	auditLogMaxSize := flags.Int64("audit-log-max-size", 100, "Size in MB after which the audit log file is rotated, 0 to disable")
+	authzPolicyFile := flags.String("authz-policy-file", "", "Static authorization policy file enforced along with intentions, reloaded on change")
+	flags.Parse(args)
+
+	ll, err := log.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.SetLevel(ll)
+
+	sd := lib.NewShutdown()
+
+	consulClient, _, err := consulFlags.client(sd)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	watcher := consul.NewIntentions(consulClient, &consulLogger{})
+	go func() {
+		if err := watcher.Run(); err != nil {
+			log.Error(err)
+			sd.Shutdown(err.Error())
+		}
+	}()
+
+	agent := haproxy.NewSPOEAgent(watcher.C, haproxy.SPOEAgentOptions{
+		ListenAddr:      *listenAddr,
+		TLSCertFile:     *tlsCertFile,
+		TLSKeyFile:      *tlsKeyFile,
+		TLSCAFile:       *tlsCAFile,
+		AuthzPolicyFile: *authzPolicyFile,
+		AuditLog:        *auditLog,
+		AuditLogMaxSize: *auditLogMaxSize * 1024 * 1024,
+	})
+	sd.Add(1)
+	go func() {
+		defer sd.Done()
+		if err := agent.Run(sd); err != nil {
+			log.Error(err)
+			sd.Shutdown(err.Error())
+		}
+	}()
+
+	sd.Wait()
+}